@@ -0,0 +1,104 @@
+package relyq
+
+import (
+	"context"
+	"github.com/Rafflecopter/golang-simpleq/simpleq"
+	"github.com/garyburd/redigo/redis"
+)
+
+// Storage kept in redis (like redisstorage.RedisStorage).
+// When it uses the same pool as the Queue, tasks are stored in the same
+// atomic step that moves them between queues.
+type RedisStorage interface {
+	Storage
+	// The pool the storage uses
+	Pool() *redis.Pool
+	// The redis key a task is stored at
+	Key(taskid []byte) string
+	// Marshal a task the way Set would store it
+	Marshal(task interface{}) ([]byte, error)
+	// Unmarshal a task the way Get would read it
+	Unmarshal(val []byte, task interface{}) error
+}
+
+// Run a transition script on a task.
+// If task is nil, the task is deleted from storage, otherwise it is saved.
+// With atomic storage, the script is given the storage key (and value) to do
+// that itself. Otherwise the Storage is updated after the script, only if it moved the task.
+// Nothing is done if ctx is already done, and its deadline bounds the redis calls.
+func (q *Queue) transition(ctx context.Context, script *redis.Script, id []byte, task interface{}, keys []interface{}, args ...interface{}) (reply interface{}, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if q.atomic != nil {
+		keys = append(keys, q.atomic.Key(id))
+		if task != nil {
+			val, err := q.atomic.Marshal(task)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, val)
+		}
+		return q.evalContext(ctx, script, keys, args...)
+	}
+
+	if reply, err = q.evalContext(ctx, script, keys, args...); err != nil || !transitioned(reply) {
+		return
+	}
+
+	if task != nil {
+		err = q.setTask(ctx, task, id)
+	} else {
+		err = q.delTask(ctx, id)
+	}
+	return
+}
+
+// Whether a transition script's reply means the task was moved.
+// They return 0, -1 or nil when it wasn't.
+func transitioned(reply interface{}) bool {
+	switch r := reply.(type) {
+	case nil:
+		return false
+	case int64:
+		return r > 0
+	}
+	return true
+}
+
+// Run a script with a variable number of keys
+func (q *Queue) eval(script *redis.Script, keys []interface{}, args ...interface{}) (interface{}, error) {
+	return q.evalContext(context.Background(), script, keys, args...)
+}
+
+// Redis key of one of the queue's own simpleqs
+func (q *Queue) keyOf(subq *simpleq.Queue) (string, bool) {
+	for level, todo := range q.Todos {
+		if subq == todo {
+			return q.todoKey(level), true
+		}
+	}
+
+	switch {
+	case subq == nil:
+		return "", false
+	case subq == q.Doing:
+		return q.Cfg.key("doing"), true
+	case subq == q.Failed:
+		return q.Cfg.key("failed"), true
+	case subq == q.Done:
+		return q.Cfg.key("done"), true
+	case subq == q.Dead:
+		return q.Cfg.key("dead"), true
+	}
+	return "", false
+}
+
+// Use one as a script argument
+func flag(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
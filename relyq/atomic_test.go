@@ -0,0 +1,81 @@
+package relyq
+
+import (
+	"testing"
+)
+
+// Hides the RedisStorage methods so the queue can't store tasks atomically
+type plainStorage struct {
+	Storage
+}
+
+func TestAtomicStorage(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	if q.atomic == nil {
+		t.Fatal("Redis storage on the same pool should be atomic")
+	}
+
+	task := ArbitraryTask{"f": "waiting"}
+	push(t, q, task)
+
+	// Finishing a task that isn't being processed fails without touching storage
+	task["g"] = "changed"
+	if err := q.Finish(task); err == nil {
+		t.Error("Finish of a task in Todo should fail")
+	}
+
+	checkTaskList(t, q, q.Todo, ArbitraryTask{"f": "waiting"})
+
+	if err := q.Fail(task); err == nil {
+		t.Error("Fail of a task in Todo should fail")
+	}
+
+	checkTaskList(t, q, q.Todo, ArbitraryTask{"f": "waiting"})
+	checkTaskList(t, q, q.Failed)
+}
+
+func TestNonAtomicStorage(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.UseDoneQueue = true
+	q := begin(plainStorage{basicStorage(cfg.Prefix)}, cfg)
+	defer end(t, q)
+
+	if q.atomic != nil {
+		t.Fatal("Storage without RedisStorage methods can't be atomic")
+	}
+
+	push(t, q, ArbitraryTask{"f": "one"})
+	push(t, q, ArbitraryTask{"f": "two"})
+	push(t, q, ArbitraryTask{"f": "three"})
+
+	tp := ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	} else if err := q.Finish(tp); err != nil {
+		t.Error("Finish", err)
+	}
+
+	tp = ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	} else {
+		tp["g"] = "failed"
+		if err := q.Fail(tp); err != nil {
+			t.Error("Fail", err)
+		}
+	}
+
+	if err := q.Remove(q.Todo, ArbitraryTask{"f": "three"}); err == nil {
+		t.Error("Remove of an unknown id should fail")
+	}
+
+	checkTaskList(t, q, q.Todo, ArbitraryTask{"f": "three"})
+	checkTaskList(t, q, q.Doing)
+	checkTaskList(t, q, q.Failed, ArbitraryTask{"f": "two", "g": "failed"})
+
+	if list, err := q.Done.List(); err != nil || len(list) != 1 {
+		t.Error("Done.List", list, err)
+	}
+}
@@ -0,0 +1,283 @@
+package relyq
+
+import (
+	"fmt"
+	"github.com/Rafflecopter/golang-relyq/scripts"
+	"github.com/garyburd/redigo/redis"
+	"github.com/yanatan16/gowaiter"
+	"time"
+)
+
+// Push many tasks onto the queue at once, in order.
+// Their ids are pushed with a single LPUSH, and with RedisStorage their
+// storage writes are pipelined. If DefaultTTL is set, the tasks expire after it.
+// With UniqueTasks, tasks are pushed one at a time and duplicates are skipped.
+// ErrDuplicate is returned if there were any.
+func (q *Queue) PushBatch(tasks []Ider) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+
+	if q.Cfg.UniqueTasks {
+		var dup error
+		for _, task := range tasks {
+			if err := q.Push(task); err == ErrDuplicate {
+				dup = err
+			} else if err != nil {
+				return err
+			}
+		}
+		return dup
+	}
+
+	lpush := make([]interface{}, 0, len(tasks)+1)
+	lpush = append(lpush, q.Cfg.key("todo"))
+	for _, task := range tasks {
+		lpush = append(lpush, task.Id())
+	}
+
+	if q.atomic != nil {
+		conn := q.pool.Get()
+		defer conn.Close()
+
+		conn.Send("MULTI")
+		if err := sendSets(conn, q.atomic, tasks); err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+		q.sendPushMetas(conn, tasks)
+		conn.Send("LPUSH", lpush...)
+		_, err := conn.Do("EXEC")
+		return err
+	}
+
+	w := waiter.New(2)
+
+	go func() {
+		if err := q.setBatch(tasks); err != nil {
+			w.Errors <- err
+		}
+		w.Done <- true
+	}()
+
+	go func() {
+		if err := q.setPushMetas(tasks); err != nil {
+			w.Errors <- err
+		} else if _, err := q.do("LPUSH", lpush...); err != nil {
+			w.Errors <- err
+		}
+		w.Done <- true
+	}()
+
+	return w.Wait()
+}
+
+// Move up to n tasks to the Doing queue and decode them into tasks made by factory.
+// With multiple priority levels, higher levels are drained first.
+// With RedisStorage, the tasks are fetched with a single MGET.
+// Returns the tasks moved, which may be fewer than n (or none). Expired tasks are skipped.
+// If some couldn't be read from storage, the rest are returned with a *BatchError.
+func (q *Queue) ProcessN(n int, factory func() Ider) ([]Ider, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	order := q.priorityOrder()
+	args := make([]interface{}, 0, len(order)+3)
+	args = append(args, len(order)+1)
+	for _, level := range order {
+		args = append(args, q.todoKey(level))
+	}
+	args = append(args, q.Cfg.key("doing"), n)
+
+	conn := q.pool.Get()
+	ids, err := redis.ByteSlices(scripts.PopPipeN.Do(conn, args...))
+	conn.Close()
+
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	expired, err := q.claim(ids...)
+	if err != nil {
+		failed := new(BatchError)
+		for _, id := range ids {
+			failed.add(id, err)
+		}
+		return nil, failed
+	}
+
+	return q.getBatch(without(ids, expired), factory)
+}
+
+// Returned by ProcessN, along with the tasks it could read, when some of the
+// tasks it moved to Doing couldn't be read from storage. Those are left in Doing,
+// so fail, requeue or remove them by id (e.g. with ArbitraryTask{"id": string(id)}).
+// List returns it too, with the whole page, when some of the listed tasks couldn't be read.
+type BatchError struct {
+	Ids  [][]byte
+	Errs []error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("relyq: %d tasks couldn't be read from storage, first %s: %s", len(e.Ids), e.Ids[0], e.Errs[0])
+}
+
+func (e *BatchError) add(id []byte, err error) {
+	e.Ids = append(e.Ids, id)
+	e.Errs = append(e.Errs, err)
+}
+
+// The error to return, nil if nothing failed
+func (e *BatchError) err() error {
+	if len(e.Ids) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Read many tasks from storage, pipelined into one MGET with RedisStorage.
+// Tasks that can't be read are skipped and returned in a *BatchError.
+func (q *Queue) getBatch(ids [][]byte, factory func() Ider) ([]Ider, error) {
+	tasks := make([]Ider, 0, len(ids))
+	if len(ids) == 0 {
+		return tasks, nil
+	}
+
+	failed := new(BatchError)
+
+	rs, ok := q.Storage.(RedisStorage)
+	if !ok {
+		for _, id := range ids {
+			task := factory()
+			if err := q.Storage.Get(id, task); err != nil {
+				failed.add(id, err)
+			} else {
+				tasks = append(tasks, task)
+			}
+		}
+		return tasks, failed.err()
+	}
+
+	keys := make([]interface{}, len(ids))
+	for i, id := range ids {
+		keys[i] = rs.Key(id)
+	}
+
+	conn := rs.Pool().Get()
+	vals, err := redis.ByteSlices(conn.Do("MGET", keys...))
+	conn.Close()
+
+	if err != nil {
+		for _, id := range ids {
+			failed.add(id, err)
+		}
+		return tasks, failed.err()
+	}
+
+	for i, val := range vals {
+		if val == nil {
+			failed.add(ids[i], fmt.Errorf("Task %s not found in storage.", ids[i]))
+			continue
+		}
+
+		task := factory()
+		if err := rs.Unmarshal(val, task); err != nil {
+			failed.add(ids[i], err)
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+
+	return tasks, failed.err()
+}
+
+// Store many tasks, pipelined with RedisStorage
+func (q *Queue) setBatch(tasks []Ider) error {
+	rs, ok := q.Storage.(RedisStorage)
+	if !ok {
+		for _, task := range tasks {
+			if err := q.Storage.Set(task, task.Id()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	conn := rs.Pool().Get()
+	defer conn.Close()
+
+	if err := sendSets(conn, rs, tasks); err != nil {
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	for range tasks {
+		if _, err := conn.Receive(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The ids not in exclude
+func without(ids, exclude [][]byte) [][]byte {
+	if len(exclude) == 0 {
+		return ids
+	}
+
+	skip := make(map[string]bool, len(exclude))
+	for _, id := range exclude {
+		skip[string(id)] = true
+	}
+
+	kept := make([][]byte, 0, len(ids)-len(exclude))
+	for _, id := range ids {
+		if !skip[string(id)] {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+// Queue up a SET for each task on a connection
+func sendSets(conn redis.Conn, rs RedisStorage, tasks []Ider) error {
+	for _, task := range tasks {
+		val, err := rs.Marshal(task)
+		if err != nil {
+			return err
+		}
+		if err := conn.Send("SET", rs.Key(task.Id()), val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Queue up an HMSET of each task's push meta on a connection
+func (q *Queue) sendPushMetas(conn redis.Conn, tasks []Ider) {
+	now, deadline := time.Now(), q.defaultDeadline(time.Now())
+	for _, task := range tasks {
+		conn.Send("HMSET", q.pushMeta(task.Id(), StateTodo, 0, now, deadline)...)
+	}
+}
+
+// Record that tasks were pushed, pipelined
+func (q *Queue) setPushMetas(tasks []Ider) error {
+	conn := q.pool.Get()
+	defer conn.Close()
+
+	q.sendPushMetas(conn, tasks)
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	for range tasks {
+		if _, err := conn.Receive(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
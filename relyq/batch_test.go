@@ -0,0 +1,90 @@
+package relyq
+
+import (
+	"testing"
+)
+
+func TestPushBatch(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "first"})
+	if err := q.PushBatch([]Ider{ArbitraryTask{"f": "a"}, ArbitraryTask{"f": "b"}, ArbitraryTask{"f": "c"}}); err != nil {
+		t.Error("PushBatch", err)
+	}
+
+	checkTaskList(t, q, q.Todo, ArbitraryTask{"f": "c"}, ArbitraryTask{"f": "b"}, ArbitraryTask{"f": "a"}, ArbitraryTask{"f": "first"})
+}
+
+func TestPushBatchNonAtomic(t *testing.T) {
+	cfg := defaultConfig()
+	q := begin(plainStorage{basicStorage(cfg.Prefix)}, cfg)
+	defer end(t, q)
+
+	if err := q.PushBatch([]Ider{ArbitraryTask{"f": "a"}, ArbitraryTask{"f": "b"}}); err != nil {
+		t.Error("PushBatch", err)
+	}
+
+	checkTaskList(t, q, q.Todo, ArbitraryTask{"f": "b"}, ArbitraryTask{"f": "a"})
+}
+
+func TestProcessN(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	if err := q.PushBatch([]Ider{&TaskStruct{F: "1"}, &TaskStruct{F: "2"}, &TaskStruct{F: "3"}}); err != nil {
+		t.Error("PushBatch", err)
+	}
+
+	factory := func() Ider { return new(TaskStruct) }
+
+	if tasks, err := q.ProcessN(2, factory); err != nil {
+		t.Error("ProcessN", err)
+	} else if len(tasks) != 2 {
+		t.Error("ProcessN should return 2 tasks", tasks)
+	} else {
+		checkTaskStructEqual(t, tasks[0].(*TaskStruct), &TaskStruct{F: "1"})
+		checkTaskStructEqual(t, tasks[1].(*TaskStruct), &TaskStruct{F: "2"})
+	}
+
+	checkTaskStructList(t, q, q.Todo, &TaskStruct{F: "3"})
+	checkTaskStructList(t, q, q.Doing, &TaskStruct{F: "2"}, &TaskStruct{F: "1"})
+
+	if tasks, err := q.ProcessN(5, factory); err != nil || len(tasks) != 1 {
+		t.Error("ProcessN should return the 1 remaining task", tasks, err)
+	}
+
+	if tasks, err := q.ProcessN(5, factory); err != nil || len(tasks) != 0 {
+		t.Error("ProcessN should return nothing", tasks, err)
+	}
+}
+
+func TestProcessNUnreadable(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	tasks := []Ider{&TaskStruct{F: "1"}, &TaskStruct{F: "2"}, &TaskStruct{F: "3"}}
+	if err := q.PushBatch(tasks); err != nil {
+		t.Error("PushBatch", err)
+	}
+	if err := q.Storage.Del(tasks[1].Id()); err != nil {
+		t.Error("Del", err)
+	}
+
+	read, err := q.ProcessN(3, func() Ider { return new(TaskStruct) })
+	if len(read) != 2 {
+		t.Error("ProcessN should return the 2 readable tasks", read)
+	}
+
+	berr, ok := err.(*BatchError)
+	if !ok {
+		t.Fatal("Expected a *BatchError", err)
+	}
+	checkIds(t, "BatchError", berr.Ids, string(tasks[1].Id()))
+
+	// The unreadable one is left in Doing with the others
+	checkTaskStructList(t, q, q.Todo)
+	if ids, err := q.Doing.List(); err != nil || len(ids) != 3 {
+		t.Error("Doing should hold all 3 tasks", ids, err)
+	}
+}
@@ -0,0 +1,43 @@
+package relyq
+
+import (
+	"github.com/Rafflecopter/golang-relyq/scripts"
+	"github.com/garyburd/redigo/redis"
+)
+
+// Withdraw a task that hasn't been handed to a worker yet, by id.
+// It is removed from Todo (any priority level), Deferred or Retrying in one step.
+// The stored task and its Meta are kept for inspection, with the state set to StateCancelled,
+// unless deleteFromStorage is true. Then they are deleted, like Remove does.
+// Returns false if it was not pending, e.g. because it is already in Doing.
+func (q *Queue) Cancel(id []byte, deleteFromStorage ...bool) (bool, error) {
+	keep := len(deleteFromStorage) == 0 || !deleteFromStorage[0]
+
+	keys := []interface{}{q.metaKey(id), q.Cfg.key("unique")}
+	for level := range q.Todos {
+		keys = append(keys, q.todoKey(level))
+	}
+	if q.Deferred != nil {
+		keys = append(keys, q.Deferred.key)
+	}
+	if q.Retrying != nil {
+		keys = append(keys, q.Retrying.key)
+	}
+
+	withStorage := !keep && q.atomic != nil
+	if withStorage {
+		keys = append(keys, q.atomic.Key(id))
+	}
+
+	n, err := redis.Int(q.eval(scripts.Cancel, keys, id, flag(!keep), flag(withStorage)))
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	if !keep && !withStorage {
+		if err := q.Storage.Del(id); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
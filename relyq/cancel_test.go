@@ -0,0 +1,87 @@
+package relyq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCancel(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AllowDefer = true
+	cfg.UniqueTasks = true
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	todo := ArbitraryTask{"id": "todo"}
+	later := ArbitraryTask{"id": "later"}
+	doing := ArbitraryTask{"id": "doing"}
+	push(t, q, doing)
+	push(t, q, todo)
+	if err := q.PushAfter(later, time.Hour); err != nil {
+		t.Error("PushAfter", err)
+	}
+
+	tp := ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	}
+
+	for _, task := range []ArbitraryTask{todo, later} {
+		if ok, err := q.Cancel(task.Id()); !ok || err != nil {
+			t.Error("Cancel", task, ok, err)
+		}
+		checkMeta(t, q, task.Id(), StateCancelled, 0)
+
+		if ok, err := q.Cancel(task.Id()); ok || err != nil {
+			t.Error("Cancel twice", task, ok, err)
+		}
+	}
+
+	if ok, err := q.Cancel(doing.Id()); ok || err != nil {
+		t.Error("Cancel shouldn't withdraw tasks in Doing", ok, err)
+	}
+
+	checkTaskList(t, q, q.Todo)
+	checkTaskList(t, q, q.Doing, doing)
+	if n, err := q.Deferred.Length(); n != 0 || err != nil {
+		t.Error("Deferred should be empty", n, err)
+	}
+
+	// The stored task is kept
+	stored := ArbitraryTask{}
+	if err := q.Storage.Get(todo.Id(), &stored); err != nil {
+		t.Error("Storage.Get", err)
+	}
+
+	// And its id can be pushed again
+	push(t, q, todo)
+	checkTaskList(t, q, q.Todo, todo)
+}
+
+func TestCancelDeletes(t *testing.T) {
+	for _, atomic := range []bool{true, false} {
+		cfg := defaultConfig()
+		var s Storage
+		if !atomic {
+			s = plainStorage{basicStorage(cfg.Prefix)}
+		}
+		q := begin(s, cfg)
+
+		task := ArbitraryTask{"id": "gone"}
+		push(t, q, task)
+
+		if ok, err := q.Cancel(task.Id(), true); !ok || err != nil {
+			t.Error("Cancel", atomic, ok, err)
+		}
+
+		checkTaskList(t, q, q.Todo)
+		if err := q.Storage.Get(task.Id(), &ArbitraryTask{}); err == nil {
+			t.Error("The stored task should be deleted", atomic)
+		}
+		if meta, err := q.Meta(task.Id()); meta != nil || err != nil {
+			t.Error("The meta should be deleted", atomic, meta, err)
+		}
+
+		end(t, q)
+	}
+}
@@ -0,0 +1,498 @@
+package relyq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"sort"
+	"strings"
+)
+
+// Returned by Check when the queue's storage isn't a RedisStorage whose keys can be scanned
+var ErrCheckNeedsRedisStorage = errors.New("relyq: Check needs a RedisStorage")
+
+// How many ids Check reads or looks up at a time
+const checkPageSize = 1000
+
+// What Check found
+type CheckReport struct {
+	// Ids in a subqueue whose stored task is missing.
+	// Done is left out unless KeepDoneTasks is set, as Finish deletes the stored tasks then.
+	MissingBodies [][]byte
+	// Stored tasks whose ids are in no subqueue, although their Meta doesn't
+	// say they were finished, cancelled or removed
+	OrphanedBodies [][]byte
+	// Ids in more than one subqueue, with the redis keys of those subqueues
+	Duplicates map[string][]string
+	// How many of the above were repaired
+	Repaired int
+}
+
+// Scan every subqueue and the storage keyspace for inconsistencies.
+// If repair is set:
+//   - ids with missing stored tasks are dropped from their subqueues along with their Meta
+//   - orphaned stored tasks are put back in the subqueue their Meta names,
+//     or deleted if they have no Meta (e.g. a Push that never got as far as Todo).
+//     Deferred or retrying ones are marked cancelled instead, as their due time is lost
+//   - ids in several subqueues are removed from those their Meta doesn't name
+//
+// Check reads the queue in pages, so tasks moving while it runs can show up as
+// false positives. Only repair a queue that is quiet.
+func (q *Queue) Check(ctx context.Context, repair bool) (*CheckReport, error) {
+	rs, ok := q.Storage.(RedisStorage)
+	if !ok {
+		return nil, ErrCheckNeedsRedisStorage
+	}
+
+	states := q.subqueueStates()
+	members, err := q.checkMembers(ctx, states)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CheckReport{Duplicates: make(map[string][]string)}
+
+	ids := make([]string, 0, len(members))
+	for id, keys := range members {
+		if q.bodiless(keys) {
+			continue
+		}
+		ids = append(ids, id)
+		if queued := inSubqueues(keys, states); len(queued) > 1 {
+			report.Duplicates[id] = queued
+		}
+	}
+	sort.Strings(ids)
+
+	if report.MissingBodies, err = q.checkMissing(ctx, rs, ids); err != nil {
+		return report, err
+	}
+	if report.OrphanedBodies, err = q.checkOrphans(ctx, rs, members); err != nil {
+		return report, err
+	}
+
+	if !repair {
+		return report, nil
+	}
+
+	for _, id := range report.MissingBodies {
+		if err := q.dropMissing(id, members[string(id)], states); err != nil {
+			return report, err
+		}
+		report.Repaired++
+	}
+
+	for _, id := range report.OrphanedBodies {
+		if err := q.restoreOrphan(id); err != nil {
+			return report, err
+		}
+		report.Repaired++
+	}
+
+	for id, keys := range report.Duplicates {
+		if fixed, err := q.dedupe([]byte(id), keys, states); err != nil {
+			return report, err
+		} else if fixed {
+			report.Repaired++
+		}
+	}
+
+	return report, nil
+}
+
+// Whether an id's stored task is meant to be gone, because it is only in Done
+// and finished tasks aren't kept (KeepDoneTasks)
+func (q *Queue) bodiless(keys []string) bool {
+	if q.Done == nil || q.Cfg.KeepDoneTasks {
+		return false
+	}
+	for _, key := range keys {
+		if key != q.Cfg.key("done") {
+			return false
+		}
+	}
+	return true
+}
+
+// The redis keys of the queue's subqueues in use, and the state of the tasks in each
+func (q *Queue) subqueueStates() map[string]string {
+	states := map[string]string{
+		q.Cfg.key("doing"):  StateDoing,
+		q.Cfg.key("failed"): StateFailed,
+	}
+	for level := range q.Todos {
+		states[q.todoKey(level)] = StateTodo
+	}
+	if q.Done != nil {
+		states[q.Cfg.key("done")] = StateDone
+	}
+	if q.Dead != nil {
+		states[q.Cfg.key("dead")] = StateDead
+	}
+	if q.Deferred != nil {
+		states[q.Deferred.key] = StateDeferred
+	}
+	if q.Retrying != nil {
+		states[q.Retrying.key] = StateRetrying
+	}
+	return states
+}
+
+// The redis key of the subqueue tasks in a state belong in, and whether it is a zset
+func (q *Queue) stateKey(state string) (key string, zset bool) {
+	switch state {
+	case StateTodo:
+		return q.Cfg.key("todo"), false
+	case StateDoing, StateFailed:
+		return q.Cfg.key(state), false
+	case StateDone:
+		if q.Done != nil {
+			return q.Cfg.key(state), false
+		}
+	case StateDead:
+		if q.Dead != nil {
+			return q.Cfg.key(state), false
+		}
+	case StateDeferred:
+		if q.Deferred != nil {
+			return q.Deferred.key, true
+		}
+	case StateRetrying:
+		if q.Retrying != nil {
+			return q.Retrying.key, true
+		}
+	}
+	return "", false
+}
+
+// Map every id in a subqueue (or the recurring set) to the keys it is in
+func (q *Queue) checkMembers(ctx context.Context, states map[string]string) (map[string][]string, error) {
+	members := make(map[string][]string)
+	add := func(key string, ids [][]byte) {
+		for _, id := range ids {
+			members[string(id)] = append(members[string(id)], key)
+		}
+	}
+
+	conn := q.pool.Get()
+	defer conn.Close()
+
+	for key, state := range states {
+		if state == StateDeferred || state == StateRetrying {
+			if err := scanZset(ctx, conn, key, func(ids [][]byte) { add(key, ids) }); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		for start := 0; ; start += checkPageSize {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			ids, err := redis.ByteSlices(conn.Do("LRANGE", key, start, start+checkPageSize-1))
+			if err != nil {
+				return nil, err
+			}
+			add(key, ids)
+			if len(ids) < checkPageSize {
+				break
+			}
+		}
+	}
+
+	if q.Cfg.AllowRecur {
+		key := q.Cfg.key("recurring")
+		err := scanZset(ctx, conn, key, func(refs [][]byte) {
+			for i, ref := range refs {
+				if j := bytes.LastIndexByte(ref, '|'); j >= 0 {
+					refs[i] = ref[:j]
+				}
+			}
+			add(key, refs)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return members, nil
+}
+
+// Call fn with each page of members of a zset
+func scanZset(ctx context.Context, conn redis.Conn, key string, fn func([][]byte)) error {
+	cursor := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		reply, err := redis.Values(conn.Do("ZSCAN", key, cursor, "COUNT", checkPageSize))
+		if err != nil {
+			return err
+		}
+
+		var page [][]byte
+		if _, err := redis.Scan(reply, &cursor, &page); err != nil {
+			return err
+		}
+
+		// ZSCAN returns members and scores interleaved
+		ids := make([][]byte, 0, len(page)/2)
+		for i := 0; i < len(page); i += 2 {
+			ids = append(ids, page[i])
+		}
+		fn(ids)
+
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// The ids whose stored tasks are missing
+func (q *Queue) checkMissing(ctx context.Context, rs RedisStorage, ids []string) ([][]byte, error) {
+	var missing [][]byte
+
+	conn := rs.Pool().Get()
+	defer conn.Close()
+
+	for start := 0; start < len(ids); start += checkPageSize {
+		if err := ctx.Err(); err != nil {
+			return missing, err
+		}
+
+		page := ids[start:]
+		if len(page) > checkPageSize {
+			page = page[:checkPageSize]
+		}
+
+		for _, id := range page {
+			conn.Send("EXISTS", rs.Key([]byte(id)))
+		}
+		if err := conn.Flush(); err != nil {
+			return missing, err
+		}
+
+		for _, id := range page {
+			if exists, err := redis.Bool(conn.Receive()); err != nil {
+				return missing, err
+			} else if !exists {
+				missing = append(missing, []byte(id))
+			}
+		}
+	}
+
+	return missing, nil
+}
+
+// The stored tasks that are in no subqueue but should be
+func (q *Queue) checkOrphans(ctx context.Context, rs RedisStorage, members map[string][]string) ([][]byte, error) {
+	var orphans [][]byte
+	prefix := rs.Key(nil)
+
+	conn := rs.Pool().Get()
+	defer conn.Close()
+
+	cursor := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return orphans, err
+		}
+
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", escapeGlob(prefix)+"*", "COUNT", checkPageSize))
+		if err != nil {
+			return orphans, err
+		}
+
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return orphans, err
+		}
+
+		var candidates [][]byte
+		for _, key := range keys {
+			id := strings.TrimPrefix(key, prefix)
+			if _, ok := members[id]; !ok {
+				candidates = append(candidates, []byte(id))
+			}
+		}
+
+		found, err := q.shouldBeQueued(candidates)
+		if err != nil {
+			return orphans, err
+		}
+		orphans = append(orphans, found...)
+
+		if cursor == 0 {
+			return orphans, nil
+		}
+	}
+}
+
+// The ids whose Meta is missing or names a subqueue
+func (q *Queue) shouldBeQueued(ids [][]byte) ([][]byte, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	conn := q.pool.Get()
+	defer conn.Close()
+
+	for _, id := range ids {
+		conn.Send("EXISTS", q.metaKey(id))
+		conn.Send("HGET", q.metaKey(id), "state")
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	var queued [][]byte
+	for _, id := range ids {
+		exists, err := redis.Bool(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+
+		state, err := redis.String(conn.Receive())
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+
+		if !exists {
+			queued = append(queued, id)
+		} else if key, _ := q.stateKey(state); key != "" {
+			queued = append(queued, id)
+		}
+	}
+	return queued, nil
+}
+
+// The keys that are subqueues
+func inSubqueues(keys []string, states map[string]string) []string {
+	var queued []string
+	for _, key := range keys {
+		if _, ok := states[key]; ok {
+			queued = append(queued, key)
+		}
+	}
+	return queued
+}
+
+// Drop an id whose stored task is gone from its subqueues (and the recurring set)
+func (q *Queue) dropMissing(id []byte, keys []string, states map[string]string) error {
+	for _, key := range keys {
+		if key == q.Cfg.key("recurring") {
+			if _, err := q.CancelRecurring(id); err != nil {
+				return err
+			}
+		} else if err := q.removeFromKey(key, states[key], id); err != nil {
+			return err
+		}
+	}
+
+	_, err := q.do("ZREM", q.Cfg.key("claims"), id)
+	if err == nil {
+		err = q.release(id)
+	}
+	if err == nil {
+		_, err = q.do("DEL", q.metaKey(id))
+	}
+	return err
+}
+
+// Put an orphaned stored task back where its Meta says it belongs, or delete it if it has no Meta
+func (q *Queue) restoreOrphan(id []byte) error {
+	m, err := q.Meta(id)
+	if err != nil {
+		return err
+	} else if m == nil || m.State == "" {
+		return q.deleteTask(id)
+	}
+	state := m.State
+
+	// Nothing says when a deferred task was due, or that anyone still wants it
+	if state == StateDeferred || state == StateRetrying {
+		_, err = q.do("HSET", q.metaKey(id), "state", StateCancelled)
+		return err
+	}
+
+	key, _ := q.stateKey(state)
+	if state == StateTodo {
+		key = q.todoKey(q.levelOf(m))
+	}
+	_, err = q.do("LPUSH", key, id)
+
+	pending := state == StateTodo || state == StateDoing
+	if err == nil && q.Cfg.UniqueTasks && pending {
+		_, err = q.do("SADD", q.Cfg.key("unique"), id)
+	}
+	return err
+}
+
+// Remove an id from the subqueues its Meta doesn't name, and any extra copies from the one it does.
+// Returns false if nothing was removed, such as when its Meta names none of them.
+func (q *Queue) dedupe(id []byte, keys []string, states map[string]string) (bool, error) {
+	state, err := redis.String(q.do("HGET", q.metaKey(id), "state"))
+	if err == redis.ErrNil {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	keep := ""
+	for _, key := range keys {
+		if states[key] == state {
+			keep = key
+			break
+		}
+	}
+	if keep == "" {
+		return false, nil
+	}
+
+	removed := false
+	copies := 0
+	for _, key := range keys {
+		if key == keep {
+			copies++
+		} else if err := q.removeFromKey(key, states[key], id); err != nil {
+			return false, err
+		} else {
+			removed = true
+		}
+	}
+
+	// Listed more than once in the subqueue it belongs in
+	if copies > 1 {
+		if _, err := q.do("LREM", keep, copies-1, id); err != nil {
+			return false, err
+		}
+		removed = true
+	}
+	return removed, nil
+}
+
+// Remove an id from a subqueue by its redis key
+func (q *Queue) removeFromKey(key, state string, id []byte) error {
+	var err error
+	if state == StateDeferred || state == StateRetrying {
+		_, err = q.do("ZREM", key, id)
+	} else {
+		_, err = q.do("LREM", key, 0, id)
+	}
+	return err
+}
+
+// Escape the special characters of a redis MATCH pattern
+func escapeGlob(s string) string {
+	var b bytes.Buffer
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
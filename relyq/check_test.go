@@ -0,0 +1,150 @@
+package relyq
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	rs := q.Storage.(RedisStorage)
+
+	ok := ArbitraryTask{"id": "ok"}
+	push(t, q, ok)
+
+	// An id whose stored task is gone
+	push(t, q, ArbitraryTask{"id": "nobody"})
+	if err := q.Storage.Del([]byte("nobody")); err != nil {
+		t.Error("Del", err)
+	}
+
+	// A stored task that never made it onto Todo, without and with meta
+	if err := q.Storage.Set(ArbitraryTask{"id": "stray"}, []byte("stray")); err != nil {
+		t.Error("Set", err)
+	}
+	if err := q.Storage.Set(ArbitraryTask{"id": "lost"}, []byte("lost")); err != nil {
+		t.Error("Set", err)
+	}
+	q.do("HSET", q.metaKey([]byte("lost")), "state", StateTodo)
+
+	// An id in two subqueues
+	twice := ArbitraryTask{"id": "twice"}
+	push(t, q, twice)
+	q.do("LPUSH", q.Cfg.key("failed"), "twice")
+
+	report, err := q.Check(context.Background(), false)
+	if err != nil {
+		t.Fatal("Check", err)
+	}
+	checkIds(t, "MissingBodies", report.MissingBodies, "nobody")
+	checkIds(t, "OrphanedBodies", report.OrphanedBodies, "lost", "stray")
+	if len(report.Duplicates) != 1 || len(report.Duplicates["twice"]) != 2 {
+		t.Error("Duplicates", report.Duplicates)
+	}
+	if report.Repaired != 0 {
+		t.Error("Nothing should be repaired", report.Repaired)
+	}
+
+	report, err = q.Check(context.Background(), true)
+	if err != nil || report.Repaired != 4 {
+		t.Fatal("Check repair", report, err)
+	}
+
+	checkTaskList(t, q, q.Todo, ArbitraryTask{"id": "lost"}, twice, ok)
+	checkTaskList(t, q, q.Failed)
+	if exists, _ := q.do("EXISTS", rs.Key([]byte("stray"))); exists.(int64) != 0 {
+		t.Error("Stray task should be deleted")
+	}
+
+	report, err = q.Check(context.Background(), false)
+	if err != nil || len(report.MissingBodies)+len(report.OrphanedBodies)+len(report.Duplicates) != 0 {
+		t.Error("Queue should be consistent after repair", report, err)
+	}
+}
+
+func TestCheckCancelled(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := q.Check(ctx, false); err != context.Canceled {
+		t.Error("Expected context.Canceled", err)
+	}
+
+	q = begin(plainStorage{basicStorage(q.Cfg.Prefix)}, defaultConfig())
+	defer end(t, q)
+	if _, err := q.Check(context.Background(), false); err != ErrCheckNeedsRedisStorage {
+		t.Error("Expected ErrCheckNeedsRedisStorage", err)
+	}
+}
+
+func TestCheckDoneWithoutBodies(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.UseDoneQueue = true
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	task := ArbitraryTask{"id": "d1"}
+	push(t, q, task)
+	var tp ArbitraryTask
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Fatal("Process", ok, err)
+	}
+	if err := q.Finish(task); err != nil {
+		t.Fatal("Finish", err)
+	}
+
+	report, err := q.Check(context.Background(), true)
+	if err != nil {
+		t.Fatal("Check", err)
+	}
+	checkIds(t, "MissingBodies", report.MissingBodies)
+	if report.Repaired != 0 {
+		t.Error("Nothing should be repaired", report.Repaired)
+	}
+	if ids, err := q.Done.List(); err != nil || len(ids) != 1 {
+		t.Error("Done should keep its id", ids, err)
+	}
+}
+
+func TestCheckListedTwice(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	task := ArbitraryTask{"id": "twice"}
+	push(t, q, task)
+	q.do("LPUSH", q.Cfg.key("todo"), "twice")
+
+	report, err := q.Check(context.Background(), true)
+	if err != nil || report.Repaired != 1 {
+		t.Fatal("Check repair", report, err)
+	}
+	checkTaskList(t, q, q.Todo, task)
+
+	// Listed once, but Meta names no subqueue it is in: nothing to repair
+	q.do("LPUSH", q.Cfg.key("failed"), "twice")
+	q.do("HSET", q.metaKey([]byte("twice")), "state", StateDone)
+	report, err = q.Check(context.Background(), true)
+	if err != nil || len(report.Duplicates) != 1 || report.Repaired != 0 {
+		t.Error("Duplicate left alone shouldn't count as repaired", report, err)
+	}
+}
+
+func checkIds(t *testing.T, what string, ids [][]byte, expected ...string) {
+	if len(ids) != len(expected) {
+		t.Error(what, "expected", expected, "got", len(ids))
+		return
+	}
+	found := make(map[string]bool)
+	for _, id := range ids {
+		found[string(id)] = true
+	}
+	for _, id := range expected {
+		if !found[id] {
+			t.Error(what, "missing", id)
+		}
+	}
+}
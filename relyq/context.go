@@ -0,0 +1,93 @@
+package relyq
+
+import (
+	"context"
+	"github.com/Rafflecopter/golang-relyq/storage/redis"
+	"github.com/garyburd/redigo/redis"
+)
+
+// Storage that can be cancelled or given a deadline.
+// The Queue's Context methods use it when the storage implements it.
+type ContextStorage interface {
+	Storage
+	// Get a task object
+	GetContext(ctx context.Context, taskid []byte, task interface{}) error
+	// Save a task object
+	SetContext(ctx context.Context, task interface{}, taskid []byte) error
+	// Delete the task object in the storage
+	DelContext(ctx context.Context, taskid []byte) error
+}
+
+// Get a task from storage, with ctx if the storage takes one
+func (q *Queue) getTask(ctx context.Context, id []byte, task interface{}) error {
+	if cs, ok := q.Storage.(ContextStorage); ok {
+		return cs.GetContext(ctx, id, task)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return q.Storage.Get(id, task)
+}
+
+// Save a task to storage, with ctx if the storage takes one
+func (q *Queue) setTask(ctx context.Context, task interface{}, id []byte) error {
+	if cs, ok := q.Storage.(ContextStorage); ok {
+		return cs.SetContext(ctx, task, id)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return q.Storage.Set(task, id)
+}
+
+// Delete a task from storage, with ctx if the storage takes one
+func (q *Queue) delTask(ctx context.Context, id []byte) error {
+	if cs, ok := q.Storage.(ContextStorage); ok {
+		return cs.DelContext(ctx, id)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return q.Storage.Del(id)
+}
+
+// A connection whose commands give up at ctx's deadline.
+// A context cancelled without a deadline is only noticed between commands.
+type ctxConn struct {
+	redis.Conn
+	ctx context.Context
+}
+
+// Get a connection from the pool that is bound to ctx
+func (q *Queue) connContext(ctx context.Context) (redis.Conn, error) {
+	conn, err := q.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ctxConn{conn, ctx}, nil
+}
+
+func (c ctxConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return redisstorage.DoContext(c.ctx, c.Conn, cmd, args...)
+}
+
+// Run a command, giving up at ctx's deadline
+func (q *Queue) doContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	conn, err := q.connContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.Do(cmd, args...)
+}
+
+// Run a script with a variable number of keys, giving up at ctx's deadline
+func (q *Queue) evalContext(ctx context.Context, script *redis.Script, keys []interface{}, args ...interface{}) (interface{}, error) {
+	conn, err := q.connContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return script.Do(conn, append(append([]interface{}{len(keys)}, keys...), args...)...)
+}
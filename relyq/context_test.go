@@ -0,0 +1,113 @@
+package relyq
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestContextDone(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	task := ArbitraryTask{"f": "never"}
+	if err := q.PushContext(ctx, task); err != context.Canceled {
+		t.Error("PushContext should fail with a done context", err)
+	}
+	checkTaskList(t, q, q.Todo)
+
+	push(t, q, task)
+	tp := ArbitraryTask{}
+	if ok, err := q.ProcessContext(ctx, &tp); ok || err != context.Canceled {
+		t.Error("ProcessContext should fail with a done context", ok, err)
+	}
+	checkTaskList(t, q, q.Todo, task)
+
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	}
+	if err := q.FinishContext(ctx, tp); err != context.Canceled {
+		t.Error("FinishContext should fail with a done context", err)
+	}
+	if err := q.FailContext(ctx, tp); err != context.Canceled {
+		t.Error("FailContext should fail with a done context", err)
+	}
+	checkTaskList(t, q, q.Doing, task)
+
+	if err := q.FinishContext(context.Background(), tp); err != nil {
+		t.Error("FinishContext", err)
+	}
+	checkTaskList(t, q, q.Doing)
+}
+
+func TestBProcessContext(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	tp := ArbitraryTask{}
+	if err := q.BProcessContext(ctx, &tp); err != context.DeadlineExceeded {
+		t.Error("Expected context.DeadlineExceeded", err)
+	}
+	if time.Since(start) > 1500*time.Millisecond {
+		t.Error("BProcessContext took too long to notice the deadline", time.Since(start))
+	}
+
+	push(t, q, ArbitraryTask{"f": "ready"})
+	if err := q.BProcessContext(context.Background(), &tp); err != nil {
+		t.Error("BProcessContext", err)
+	}
+	checkTaskEqual(t, tp, ArbitraryTask{"f": "ready"})
+}
+
+func TestContextDeadline(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := q.doContext(ctx, "BLPOP", q.Cfg.key("nothing"), 2); err != context.DeadlineExceeded {
+		t.Error("Expected context.DeadlineExceeded", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("A redis call should give up at the deadline", time.Since(start))
+	}
+
+	if err := q.PushContext(context.Background(), ArbitraryTask{"f": "after"}); err != nil {
+		t.Error("PushContext", err)
+	}
+	checkTaskList(t, q, q.Todo, ArbitraryTask{"f": "after"})
+}
+
+func TestBProcessContextCancelClaimed(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tp := ArbitraryTask{}
+	done := make(chan error)
+	go func() { done <- q.BProcessContext(ctx, &tp) }()
+
+	// Cancel while the pop is already handing over the task
+	time.Sleep(50 * time.Millisecond)
+	push(t, q, ArbitraryTask{"f": "raced"})
+	cancel()
+
+	if err := <-done; err == nil {
+		checkTaskEqual(t, tp, ArbitraryTask{"f": "raced"})
+		checkTaskList(t, q, q.Doing, ArbitraryTask{"f": "raced"})
+	} else {
+		checkTaskList(t, q, q.Todo, ArbitraryTask{"f": "raced"})
+		checkTaskList(t, q, q.Doing)
+	}
+}
@@ -0,0 +1,51 @@
+package relyq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Rafflecopter/golang-relyq/scripts"
+	"github.com/garyburd/redigo/redis"
+)
+
+// Returned when using the Dead queue on a queue without UseDeadQueue
+var ErrNoDeadQueue = errors.New("relyq: dead queue is not enabled (Config.UseDeadQueue)")
+
+// Give up on a task in the Doing (or Failed) queue, moving it to the Dead queue.
+// The reason is recorded and can be read back with Reason.
+func (q *Queue) Kill(task Ider, reason string) error {
+	if q.Dead == nil {
+		return ErrNoDeadQueue
+	}
+
+	id := task.Id()
+	keys := []interface{}{q.Cfg.key("doing"), q.Cfg.key("failed"), q.Cfg.key("dead"),
+		q.Cfg.key("claims"), q.metaKey(id), q.Cfg.key("unique")}
+
+	n, err := redis.Int(q.transition(context.Background(), scripts.Kill, id, task, keys, id, reason))
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("Task %s not found in Doing or Failed queues.", id)
+	}
+	q.dropLease(id)
+	return nil
+}
+
+// Move a dead task back onto the Todo queue, resetting its attempts and reason
+func (q *Queue) Resurrect(id []byte) error {
+	if q.Dead == nil {
+		return ErrNoDeadQueue
+	}
+
+	conn := q.pool.Get()
+	defer conn.Close()
+
+	if n, err := redis.Int(scripts.Resurrect.Do(conn, q.Cfg.key("dead"), q.Cfg.key("todo"), q.metaKey(id),
+		q.Cfg.key("unique"), id, flag(q.Cfg.UniqueTasks), q.Cfg.Delimiter, q.Cfg.PriorityLevels)); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("Task %s not found in Dead queue.", id)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package relyq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKill(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.UseDeadQueue = true
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "poison"})
+	push(t, q, ArbitraryTask{"f": "fine"})
+
+	tp := ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	}
+
+	tp["g"] = "bad input"
+	if err := q.Kill(tp, "malformed"); err != nil {
+		t.Error("Kill", err)
+	}
+
+	checkTaskList(t, q, q.Doing)
+	checkTaskList(t, q, q.Failed)
+	checkTaskList(t, q, q.Dead, ArbitraryTask{"f": "poison", "g": "bad input"})
+
+	if reason, err := q.Reason(tp.Id()); err != nil || reason != "malformed" {
+		t.Error("Reason", reason, err)
+	}
+
+	if err := q.Kill(tp, "again"); err == nil {
+		t.Error("Killing a dead task should fail")
+	}
+
+	if err := q.Resurrect(tp.Id()); err != nil {
+		t.Error("Resurrect", err)
+	}
+
+	checkTaskList(t, q, q.Dead)
+	checkTaskList(t, q, q.Todo, ArbitraryTask{"f": "poison", "g": "bad input"}, ArbitraryTask{"f": "fine"})
+
+	if reason, err := q.Reason(tp.Id()); err != nil || reason != "" {
+		t.Error("Reason should be reset", reason, err)
+	}
+}
+
+func TestDeadAfterRetries(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.UseDeadQueue = true
+	cfg.MaxAttempts = 2
+	cfg.RetryBackoff = 10 * time.Millisecond
+	cfg.DeferPollInterval = 5 * time.Millisecond
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "flaky"})
+
+	tp := ArbitraryTask{}
+	for i := 0; i < 2; i++ {
+		if err := q.BProcess(1, &tp); err != nil {
+			t.Error("BProcess", err)
+			return
+		}
+		if err := q.Fail(tp); err != nil {
+			t.Error("Fail", err)
+		}
+	}
+
+	checkTaskList(t, q, q.Failed)
+	checkTaskList(t, q, q.Dead, ArbitraryTask{"f": "flaky"})
+
+	if reason, err := q.Reason(tp.Id()); err != nil || reason != ReasonExhausted {
+		t.Error("Reason", reason, err)
+	}
+
+	if err := q.Resurrect(tp.Id()); err != nil {
+		t.Error("Resurrect", err)
+	}
+	if n, err := q.Attempts(tp.Id()); err != nil || n != 0 {
+		t.Error("Attempts should be reset", n, err)
+	}
+}
+
+func TestNoDeadQueue(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	if err := q.Kill(ArbitraryTask{}, "nope"); err != ErrNoDeadQueue {
+		t.Error("Expected ErrNoDeadQueue", err)
+	}
+}
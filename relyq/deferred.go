@@ -0,0 +1,152 @@
+package relyq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Rafflecopter/golang-relyq/scripts"
+	"github.com/garyburd/redigo/redis"
+	"github.com/yanatan16/gowaiter"
+	"time"
+)
+
+// Returned when deferring a task on a queue without AllowDefer
+var ErrDeferNotAllowed = errors.New("relyq: deferred tasks are not enabled (Config.AllowDefer)")
+
+// A redis zset of task ids waiting to be moved onto the Todo queue.
+// Each id is scored by the time (in unix milliseconds) it should be moved.
+type Deferred struct {
+	pool *redis.Pool
+	key  string
+	// The unique set, with UniqueTasks
+	unique string
+	// Prefix of the tasks' meta hashes
+	meta string
+}
+
+// List the deferred task ids, earliest first
+func (d *Deferred) List() ([][]byte, error) {
+	return redis.ByteSlices(d.do("ZRANGE", d.key, 0, -1))
+}
+
+// Number of deferred tasks
+func (d *Deferred) Length() (int64, error) {
+	return redis.Int64(d.do("ZCARD", d.key))
+}
+
+// When a deferred task will be moved onto the Todo queue. ok is false if the task is not deferred.
+func (d *Deferred) When(id []byte) (when time.Time, ok bool, err error) {
+	ms, err := redis.Int64(d.do("ZSCORE", d.key, id))
+	if err == redis.ErrNil {
+		return time.Time{}, false, nil
+	} else if err != nil {
+		return time.Time{}, false, err
+	}
+	return fromMillis(ms), true, nil
+}
+
+// Cancel a deferred task so it is never moved onto the Todo queue.
+// With UniqueTasks, its id is released in the same step so it can be pushed again.
+// Its Meta state is set to StateCancelled and the stored task is kept, like Queue.Cancel
+// (see Queue.RemoveDeferred to delete it). Returns false if the task was not deferred.
+func (d *Deferred) Cancel(id []byte) (bool, error) {
+	conn := d.pool.Get()
+	defer conn.Close()
+	n, err := redis.Int(scripts.DeferCancel.Do(conn, d.key, d.unique, d.meta+string(id), id, flag(d.unique != "")))
+	return n > 0, err
+}
+
+// Remove all deferred tasks
+func (d *Deferred) Clear() (int64, error) {
+	return redis.Int64(d.do("DEL", d.key))
+}
+
+// Move all tasks whose time has come onto the todo list of their priority level,
+// updating their state in their meta hashes
+func (d *Deferred) moveTo(q *Queue, now time.Time) error {
+	conn := d.pool.Get()
+	defer conn.Close()
+	_, err := scripts.DeferMove.Do(conn, d.key, q.Cfg.key("todo"), toMillis(now), q.metaKey(nil),
+		q.Cfg.Delimiter, q.Cfg.PriorityLevels)
+	return err
+}
+
+func (d *Deferred) do(cmd string, args ...interface{}) (interface{}, error) {
+	conn := d.pool.Get()
+	defer conn.Close()
+	return conn.Do(cmd, args...)
+}
+
+// Push a task to be moved onto the Todo queue at a certain time
+// If DefaultTTL is set, the task expires that long after this time.
+func (q *Queue) PushAt(task Ider, when time.Time) error {
+	if q.Deferred == nil {
+		return ErrDeferNotAllowed
+	}
+
+	id := task.Id()
+	deadline := q.defaultDeadline(when)
+	if q.Cfg.UniqueTasks {
+		return q.pushUnique(context.Background(), task, id, q.Deferred.key, toMillis(when), 0, deadline)
+	}
+
+	w := waiter.New(2)
+
+	go func() {
+		if err := q.Storage.Set(task, id); err != nil {
+			w.Errors <- err
+		}
+		w.Done <- true
+	}()
+
+	go func() {
+		if _, err := q.do("HMSET", q.pushMeta(id, StateDeferred, 0, time.Now(), deadline)...); err != nil {
+			w.Errors <- err
+		} else if _, err := q.Deferred.do("ZADD", q.Deferred.key, toMillis(when), id); err != nil {
+			w.Errors <- err
+		}
+		w.Done <- true
+	}()
+
+	return w.Wait()
+}
+
+// Push a task to be moved onto the Todo queue after a duration
+func (q *Queue) PushAfter(task Ider, after time.Duration) error {
+	return q.PushAt(task, time.Now().Add(after))
+}
+
+// Cancel a deferred task and delete it from storage
+// If keepInStorage (single extra arg) is true, then no delete call will be done for the task
+func (q *Queue) RemoveDeferred(task Ider, keepInStorage ...bool) error {
+	if q.Deferred == nil {
+		return ErrDeferNotAllowed
+	}
+
+	id := task.Id()
+	keep := len(keepInStorage) > 0 && keepInStorage[0]
+
+	var keepTask interface{}
+	if keep {
+		keepTask = task
+	}
+
+	n, err := redis.Int(q.transition(context.Background(), scripts.DeferRemove, id, keepTask,
+		[]interface{}{q.Deferred.key, q.metaKey(id), q.Cfg.key("unique")},
+		id, flag(!keep)))
+
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("Task %s not found in Deferred set.", id)
+	}
+	return nil
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromMillis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
@@ -0,0 +1,138 @@
+package relyq
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPushAfter(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AllowDefer = true
+	cfg.DeferPollInterval = 10 * time.Millisecond
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	task := ArbitraryTask{"f": "later"}
+	if err := q.PushAfter(task, 50*time.Millisecond); err != nil {
+		t.Error("PushAfter", err)
+	}
+	push(t, q, ArbitraryTask{"f": "now"})
+
+	if when, ok, err := q.Deferred.When(task.Id()); err != nil || !ok {
+		t.Error("When", ok, err)
+	} else if when.Before(time.Now()) {
+		t.Error("Deferred task scheduled in the past", when)
+	}
+
+	checkTaskList(t, q, q.Todo, ArbitraryTask{"f": "now"})
+
+	time.Sleep(100 * time.Millisecond)
+
+	checkTaskList(t, q, q.Todo, ArbitraryTask{"f": "later"}, ArbitraryTask{"f": "now"})
+	if n, err := q.Deferred.Length(); err != nil || n != 0 {
+		t.Error("Deferred should be empty", n, err)
+	}
+}
+
+func TestPushAtOrder(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AllowDefer = true
+	cfg.DeferPollInterval = 10 * time.Millisecond
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	now := time.Now()
+	if err := q.PushAt(ArbitraryTask{"f": "second"}, now.Add(-time.Second)); err != nil {
+		t.Error("PushAt", err)
+	}
+	if err := q.PushAt(ArbitraryTask{"f": "first"}, now.Add(-2*time.Second)); err != nil {
+		t.Error("PushAt", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	tp := ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	} else {
+		checkTaskEqual(t, tp, ArbitraryTask{"f": "first"})
+	}
+	checkTaskList(t, q, q.Todo, ArbitraryTask{"f": "second"})
+}
+
+func TestRemoveDeferred(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AllowDefer = true
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	task := ArbitraryTask{"f": "never"}
+	if err := q.PushAfter(task, time.Hour); err != nil {
+		t.Error("PushAfter", err)
+	}
+
+	if list, err := q.Deferred.List(); err != nil || len(list) != 1 || string(list[0]) != string(task.Id()) {
+		t.Error("Deferred.List", list, err)
+	}
+
+	if err := q.RemoveDeferred(task); err != nil {
+		t.Error("RemoveDeferred", err)
+	}
+
+	if _, ok, err := q.Deferred.When(task.Id()); ok || err != nil {
+		t.Error("Task should not be deferred anymore", ok, err)
+	}
+	if err := q.RemoveDeferred(task); err == nil {
+		t.Error("RemoveDeferred of a missing task should fail")
+	}
+}
+
+func TestDeferredCancel(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AllowDefer = true
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	task := ArbitraryTask{"f": "never"}
+	if err := q.PushAfter(task, time.Hour); err != nil {
+		t.Error("PushAfter", err)
+	}
+	if ok, err := q.Deferred.Cancel(task.Id()); !ok || err != nil {
+		t.Error("Deferred.Cancel", ok, err)
+	}
+	checkMeta(t, q, task.Id(), StateCancelled, 0)
+
+	// Check leaves it cancelled rather than deferring it again
+	if report, err := q.Check(context.Background(), true); err != nil || len(report.OrphanedBodies) != 0 {
+		t.Error("Check", report, err)
+	}
+	if _, ok, err := q.Deferred.When(task.Id()); ok || err != nil {
+		t.Error("Task should not be deferred again", ok, err)
+	}
+
+	// A body left deferred but out of the zset isn't deferred again either
+	later := ArbitraryTask{"f": "lost"}
+	if err := q.PushAfter(later, time.Hour); err != nil {
+		t.Error("PushAfter", err)
+	}
+	if _, err := q.Deferred.do("ZREM", q.Deferred.key, later.Id()); err != nil {
+		t.Error("ZREM", err)
+	}
+	if report, err := q.Check(context.Background(), true); err != nil || len(report.OrphanedBodies) != 1 {
+		t.Error("Check", report, err)
+	}
+	if _, ok, err := q.Deferred.When(later.Id()); ok || err != nil {
+		t.Error("Orphan should not be deferred again", ok, err)
+	}
+	checkMeta(t, q, later.Id(), StateCancelled, 0)
+}
+
+func TestDeferNotAllowed(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	if err := q.PushAfter(ArbitraryTask{}, time.Second); err != ErrDeferNotAllowed {
+		t.Error("Expected ErrDeferNotAllowed", err)
+	}
+}
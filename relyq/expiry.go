@@ -0,0 +1,36 @@
+package relyq
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Reason set on tasks that expired before they could be processed
+const ReasonExpired = "expired"
+
+// Returned when pushing a task with a deadline on a queue without UseDeadlines
+var ErrDeadlinesNotEnabled = errors.New("relyq: task deadlines are not enabled (Config.UseDeadlines)")
+
+// Push a task that expires at a deadline.
+// If it hasn't been handed to a worker by then, it is moved to the Dead
+// queue (or Failed, without UseDeadQueue) with ReasonExpired instead.
+func (q *Queue) PushDeadline(task Ider, deadline time.Time) error {
+	if !q.Cfg.UseDeadlines {
+		return ErrDeadlinesNotEnabled
+	}
+	return q.push(context.Background(), task, task.Id(), 0, deadline)
+}
+
+// Push a task that expires after a duration
+func (q *Queue) PushTTL(task Ider, ttl time.Duration) error {
+	return q.PushDeadline(task, time.Now().Add(ttl))
+}
+
+// The deadline of a task pushed at a time, if DefaultTTL is set
+func (q *Queue) defaultDeadline(from time.Time) time.Time {
+	if q.Cfg.DefaultTTL <= 0 {
+		return time.Time{}
+	}
+	return from.Add(q.Cfg.DefaultTTL)
+}
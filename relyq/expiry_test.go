@@ -0,0 +1,77 @@
+package relyq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPushTTL(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.UseDeadlines = true
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	stale := ArbitraryTask{"f": "stale"}
+	if err := q.PushTTL(stale, 10*time.Millisecond); err != nil {
+		t.Error("PushTTL", err)
+	}
+	if err := q.PushTTL(ArbitraryTask{"f": "fresh"}, time.Hour); err != nil {
+		t.Error("PushTTL", err)
+	}
+	push(t, q, ArbitraryTask{"f": "forever"})
+
+	time.Sleep(20 * time.Millisecond)
+
+	tp := ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	} else {
+		checkTaskEqual(t, tp, ArbitraryTask{"f": "fresh"})
+	}
+
+	checkTaskList(t, q, q.Todo, ArbitraryTask{"f": "forever"})
+	checkTaskList(t, q, q.Doing, ArbitraryTask{"f": "fresh"})
+	checkTaskList(t, q, q.Failed, ArbitraryTask{"f": "stale"})
+
+	if reason, err := q.Reason(stale.Id()); err != nil || reason != ReasonExpired {
+		t.Error("Reason", reason, err)
+	}
+}
+
+func TestDefaultTTL(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.DefaultTTL = 10 * time.Millisecond
+	cfg.UseDeadQueue = true
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	if !cfg.UseDeadlines {
+		t.Error("DefaultTTL should turn on UseDeadlines")
+	}
+
+	push(t, q, &TaskStruct{F: "1"})
+	push(t, q, &TaskStruct{F: "2"})
+	time.Sleep(20 * time.Millisecond)
+	push(t, q, &TaskStruct{F: "3"})
+
+	tasks, err := q.ProcessN(3, func() Ider { return new(TaskStruct) })
+	if err != nil {
+		t.Error("ProcessN", err)
+	} else if len(tasks) != 1 {
+		t.Error("ProcessN should skip expired tasks", tasks)
+	} else {
+		checkTaskStructEqual(t, tasks[0].(*TaskStruct), &TaskStruct{F: "3"})
+	}
+
+	checkTaskStructList(t, q, q.Dead, &TaskStruct{F: "2"}, &TaskStruct{F: "1"})
+	checkTaskStructList(t, q, q.Failed)
+}
+
+func TestDeadlinesNotEnabled(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	if err := q.PushTTL(ArbitraryTask{}, time.Second); err != ErrDeadlinesNotEnabled {
+		t.Error("Expected ErrDeadlinesNotEnabled", err)
+	}
+}
@@ -0,0 +1,130 @@
+package relyq
+
+import (
+	"errors"
+	"github.com/Rafflecopter/golang-relyq/scripts"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// Returned when touching, finishing or failing a task whose claim has already been reclaimed
+var ErrLeaseLost = errors.New("relyq: lease lost, task is no longer claimed")
+
+// Extend the claim on a task in Doing by another ProcessTimeout.
+// Returns ErrLeaseLost if the task has already been reclaimed, in which case
+// the worker should abort. Does nothing without a ProcessTimeout.
+//
+// Each claim has its own token. Touch, Finish and Fail check the token of the
+// latest claim on the task made through this Queue, so they fail with ErrLeaseLost
+// once the task has been reclaimed, even if it has been claimed again since.
+func (q *Queue) Touch(task Ider) error {
+	return q.touch(task.Id(), q.leaseOf(task.Id()))
+}
+
+// Extend the claim on a task, if its claim token (when given) is still current
+func (q *Queue) touch(id []byte, token string) error {
+	if q.Cfg.ProcessTimeout <= 0 {
+		return nil
+	}
+
+	conn := q.pool.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(scripts.Touch.Do(conn, q.Cfg.key("claims"), q.metaKey(id),
+		id, toMillis(time.Now().Add(q.Cfg.ProcessTimeout)), token))
+
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// Remember the claim token of tasks this Queue claimed
+func (q *Queue) recordLease(ids [][]byte, token string) {
+	q.leaseMu.Lock()
+	defer q.leaseMu.Unlock()
+	for _, id := range ids {
+		q.leases[string(id)] = token
+	}
+}
+
+// The claim token of the latest claim on a task made through this Queue, or "" if none
+func (q *Queue) leaseOf(id []byte) string {
+	q.leaseMu.Lock()
+	defer q.leaseMu.Unlock()
+	return q.leases[string(id)]
+}
+
+// Forget the claim token of a task that has left Doing
+func (q *Queue) dropLease(id []byte) {
+	q.leaseMu.Lock()
+	defer q.leaseMu.Unlock()
+	delete(q.leases, string(id))
+}
+
+// Forget a claim token, unless the task has been claimed again since
+func (q *Queue) forgetLease(id []byte, token string) {
+	q.leaseMu.Lock()
+	defer q.leaseMu.Unlock()
+	if q.leases[string(id)] == token {
+		delete(q.leases, string(id))
+	}
+}
+
+// Keeps touching a task in the background while it is processed
+type Heartbeat struct {
+	// Receives ErrLeaseLost if the lease is lost, and is then closed
+	Lost chan error
+	stop chan bool
+}
+
+// Touch a task every interval until stopped or the lease is lost.
+// Other errors touching the task are reported on q.Errors.
+func (q *Queue) Heartbeat(task Ider, interval time.Duration) *Heartbeat {
+	return q.heartbeat(task.Id(), q.leaseOf(task.Id()), interval)
+}
+
+// Touch a task every interval, for as long as its claim token is current
+func (q *Queue) heartbeat(id []byte, token string, interval time.Duration) *Heartbeat {
+	h := &Heartbeat{
+		Lost: make(chan error, 1),
+		stop: make(chan bool),
+	}
+
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+
+		for {
+			select {
+			case <-h.stop:
+				return
+			case <-tick.C:
+				if err := q.touch(id, token); err == ErrLeaseLost {
+					h.Lost <- err
+					close(h.Lost)
+					return
+				} else if err != nil {
+					reportError(q.Errors, err)
+				}
+			}
+		}
+	}()
+
+	return h
+}
+
+// How often to touch tasks: three times per ProcessTimeout
+func (q *Queue) heartbeatInterval() time.Duration {
+	if q.Cfg.ProcessTimeout <= 0 {
+		return time.Second
+	}
+	return q.Cfg.ProcessTimeout / 3
+}
+
+// Stop touching the task
+func (h *Heartbeat) Stop() {
+	close(h.stop)
+}
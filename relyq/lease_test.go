@@ -0,0 +1,154 @@
+package relyq
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTouch(t *testing.T) {
+	q := begin(nil, timeoutConfig())
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "long"})
+
+	tp := ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	}
+
+	// Keep it alive past the timeout
+	for i := 0; i < 5; i++ {
+		time.Sleep(15 * time.Millisecond)
+		if err := q.Touch(tp); err != nil {
+			t.Error("Touch", i, err)
+		}
+	}
+	checkTaskList(t, q, q.Doing, ArbitraryTask{"f": "long"})
+
+	time.Sleep(60 * time.Millisecond)
+	checkTaskList(t, q, q.Doing)
+
+	if err := q.Touch(tp); err != ErrLeaseLost {
+		t.Error("Expected ErrLeaseLost", err)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	q := begin(nil, timeoutConfig())
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "encode"})
+
+	task := ArbitraryTask{}
+	if ok, err := q.Process(&task); !ok || err != nil {
+		t.Error("Process", ok, err)
+	}
+
+	hb := q.Heartbeat(task, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	checkTaskList(t, q, q.Doing, ArbitraryTask{"f": "encode"})
+	hb.Stop()
+
+	// Lose the lease
+	time.Sleep(60 * time.Millisecond)
+	checkTaskList(t, q, q.Doing)
+
+	hb = q.Heartbeat(task, 5*time.Millisecond)
+	select {
+	case err := <-hb.Lost:
+		if err != ErrLeaseLost {
+			t.Error("Expected ErrLeaseLost", err)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Heartbeat didn't notice the lost lease")
+	}
+}
+
+func TestLeasePerClaim(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ProcessTimeout = time.Minute
+	cfg.TimeoutPollInterval = time.Hour
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	// Another worker on the same queue
+	otherCfg := *cfg
+	other := New(pool, basicStorage(cfg.Prefix), &otherCfg)
+	defer end(t, other)
+
+	push(t, q, ArbitraryTask{"f": "slow"})
+
+	tp := ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Fatal("Process", ok, err)
+	}
+	token := q.leaseOf(tp.Id())
+
+	// The claim times out and the task is claimed again elsewhere
+	if _, err := q.reclaim(time.Now().Add(2 * cfg.ProcessTimeout)); err != nil {
+		t.Error("reclaim", err)
+	}
+	tp2 := ArbitraryTask{}
+	if ok, err := other.Process(&tp2); !ok || err != nil {
+		t.Fatal("Process elsewhere", ok, err)
+	}
+
+	if err := q.Touch(tp); err != ErrLeaseLost {
+		t.Error("Touch should lose the lease", err)
+	}
+	if err := q.Finish(tp); err != ErrLeaseLost {
+		t.Error("Finish should lose the lease", err)
+	}
+	if err := q.finish(context.Background(), tp, token); err != ErrLeaseLost {
+		t.Error("finish should lose the lease", err)
+	}
+	if _, err := q.failRetry(context.Background(), tp, nil, token); err != ErrLeaseLost {
+		t.Error("Fail should lose the lease", err)
+	}
+	checkTaskList(t, q, q.Doing, ArbitraryTask{"f": "slow"})
+
+	// The new claim still holds
+	if err := other.Touch(tp2); err != nil {
+		t.Error("Touch", err)
+	}
+	if err := other.Finish(tp2); err != nil {
+		t.Error("Finish", err)
+	}
+	checkTaskList(t, q, q.Doing)
+}
+
+func TestLeaseLostStorage(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ProcessTimeout = time.Minute
+	cfg.TimeoutPollInterval = time.Hour
+	q := begin(plainStorage{basicStorage(cfg.Prefix)}, cfg)
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "slow"})
+
+	tp := ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Fatal("Process", ok, err)
+	}
+
+	// The claim times out and the task goes back to Todo
+	if _, err := q.reclaim(time.Now().Add(2 * cfg.ProcessTimeout)); err != nil {
+		t.Error("reclaim", err)
+	}
+
+	tp["f"] = "stale"
+	if err := q.Fail(tp); err != ErrLeaseLost {
+		t.Error("Fail should lose the lease", err)
+	}
+	if err := q.Finish(tp); err != ErrLeaseLost {
+		t.Error("Finish should lose the lease", err)
+	}
+
+	// Its body is still there, untouched
+	tp2 := ArbitraryTask{}
+	if ok, err := q.Process(&tp2); !ok || err != nil {
+		t.Fatal("Process again", ok, err)
+	}
+	checkTaskEqual(t, tp2, ArbitraryTask{"f": "slow"})
+}
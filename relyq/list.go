@@ -0,0 +1,91 @@
+package relyq
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Rafflecopter/golang-simpleq/simpleq"
+	"github.com/garyburd/redigo/redis"
+)
+
+// A task in a subqueue, with what relyq knows about it
+type ListedTask struct {
+	Id []byte
+	// Nil if it couldn't be read from storage
+	Task Ider
+	// Nil if nothing is known
+	Meta *Meta
+}
+
+// Page through one of the queue's own subqueues, newest first, decoding tasks made by factory.
+// Returns up to limit tasks starting at offset, or all of them from offset if limit is 0.
+// The tasks' meta (and, with RedisStorage, the tasks themselves) are fetched in one pipeline.
+// Tasks that couldn't be read from storage are listed with a nil Task, along with a *BatchError.
+func (q *Queue) List(subq *simpleq.Queue, offset, limit int, factory func() Ider) ([]ListedTask, error) {
+	key, ok := q.keyOf(subq)
+	if !ok {
+		return nil, errors.New("Can only list the queue's own simpleqs.")
+	}
+
+	stop := -1
+	if limit > 0 {
+		stop = offset + limit - 1
+	}
+
+	ids, err := redis.ByteSlices(q.do("LRANGE", key, offset, stop))
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	rs, pipelined := q.Storage.(RedisStorage)
+	pipelined = pipelined && rs.Pool() == q.pool
+
+	conn := q.pool.Get()
+	defer conn.Close()
+
+	for _, id := range ids {
+		conn.Send("HGETALL", q.metaKey(id))
+	}
+	if pipelined {
+		for _, id := range ids {
+			conn.Send("GET", rs.Key(id))
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	listed := make([]ListedTask, len(ids))
+	for i, id := range ids {
+		listed[i].Id = id
+		fields, err := redis.StringMap(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		if listed[i].Meta, err = parseMeta(fields); err != nil {
+			return nil, err
+		}
+	}
+
+	failed := new(BatchError)
+	for i, id := range ids {
+		task := factory()
+		if pipelined {
+			val, err := redis.Bytes(conn.Receive())
+			if err == redis.ErrNil {
+				failed.add(id, fmt.Errorf("Task %s not found in storage.", id))
+				continue
+			} else if err != nil {
+				return nil, err
+			} else if err := rs.Unmarshal(val, task); err != nil {
+				failed.add(id, err)
+				continue
+			}
+		} else if err := q.Storage.Get(id, task); err != nil {
+			failed.add(id, err)
+			continue
+		}
+		listed[i].Task = task
+	}
+
+	return listed, failed.err()
+}
@@ -0,0 +1,98 @@
+package relyq
+
+import (
+	"testing"
+)
+
+func TestList(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	for _, f := range []string{"a", "b", "c", "d"} {
+		push(t, q, ArbitraryTask{"f": f})
+		tp := ArbitraryTask{}
+		if ok, err := q.Process(&tp); !ok || err != nil {
+			t.Error("Process", ok, err)
+		} else if err := q.Fail(tp); err != nil {
+			t.Error("Fail", err)
+		}
+	}
+
+	factory := func() Ider { return &ArbitraryTask{} }
+
+	page, err := q.List(q.Failed, 1, 2, factory)
+	if err != nil {
+		t.Fatal("List", err)
+	}
+	if len(page) != 2 {
+		t.Fatal("Expected 2 tasks, got", len(page))
+	}
+	checkTaskEqual(t, *page[0].Task.(*ArbitraryTask), ArbitraryTask{"f": "c"})
+	checkTaskEqual(t, *page[1].Task.(*ArbitraryTask), ArbitraryTask{"f": "b"})
+	for _, lt := range page {
+		if lt.Meta == nil || lt.Meta.State != StateFailed || lt.Meta.Attempts != 1 {
+			t.Error("Bad meta", lt.Meta)
+		}
+	}
+
+	if all, err := q.List(q.Failed, 0, 0, factory); err != nil || len(all) != 4 {
+		t.Error("List all", len(all), err)
+	}
+	if none, err := q.List(q.Failed, 10, 5, factory); err != nil || len(none) != 0 {
+		t.Error("List past the end", len(none), err)
+	}
+	if _, err := q.List(nil, 0, 0, factory); err == nil {
+		t.Error("List should reject unknown subqueues")
+	}
+}
+
+func TestListNonRedisStorage(t *testing.T) {
+	cfg := defaultConfig()
+	q := begin(plainStorage{basicStorage(cfg.Prefix)}, cfg)
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "a"})
+
+	list, err := q.List(q.Todo, 0, 0, func() Ider { return &ArbitraryTask{} })
+	if err != nil || len(list) != 1 {
+		t.Fatal("List", list, err)
+	}
+	checkTaskEqual(t, *list[0].Task.(*ArbitraryTask), ArbitraryTask{"f": "a"})
+	if list[0].Meta == nil || list[0].Meta.State != StateTodo {
+		t.Error("Bad meta", list[0].Meta)
+	}
+}
+
+func TestListMissingBody(t *testing.T) {
+	for _, pipelined := range []bool{true, false} {
+		cfg := defaultConfig()
+		var s Storage
+		if !pipelined {
+			s = plainStorage{basicStorage(cfg.Prefix)}
+		}
+		q := begin(s, cfg)
+
+		lost := ArbitraryTask{"f": "lost"}
+		push(t, q, ArbitraryTask{"f": "a"})
+		push(t, q, lost)
+		push(t, q, ArbitraryTask{"f": "c"})
+		if err := q.Storage.Del(lost.Id()); err != nil {
+			t.Error("Storage.Del", err)
+		}
+
+		list, err := q.List(q.Todo, 0, 0, func() Ider { return &ArbitraryTask{} })
+		if be, ok := err.(*BatchError); !ok || len(be.Ids) != 1 || string(be.Ids[0]) != string(lost.Id()) {
+			t.Error("Expected a BatchError for the lost task", pipelined, err)
+		}
+		if len(list) != 3 {
+			t.Fatal("The whole page should be listed", pipelined, len(list))
+		}
+		if list[1].Task != nil || string(list[1].Id) != string(lost.Id()) || list[1].Meta == nil || list[1].Meta.State != StateTodo {
+			t.Error("Lost task should be listed by id and meta", pipelined, list[1])
+		}
+		checkTaskEqual(t, *list[0].Task.(*ArbitraryTask), ArbitraryTask{"f": "c"})
+		checkTaskEqual(t, *list[2].Task.(*ArbitraryTask), ArbitraryTask{"f": "a"})
+
+		end(t, q)
+	}
+}
@@ -1,80 +1,253 @@
 package relyq
 
 import (
+	"context"
 	"github.com/Rafflecopter/golang-simpleq/simpleq"
 	"github.com/yanatan16/errorcaller"
+	"io"
 	"reflect"
+	"sync"
+	"time"
 )
 
+// Hands out tasks from a Queue as they arrive.
+// Tasks is closed once no more tasks will be handed out, then Errors once
+// Finish, Fail and FailWithError are no longer listened on, and then Done.
 type Listener struct {
-	l                   *simpleq.Listener
+	l                   io.Closer
+	elements            <-chan []byte
+	errors              <-chan error
 	Errors              chan error
 	Tasks, Fail, Finish chan Ider
 	rq                  *Queue
-	closeErrorCount     int
+
+	// Fail tasks along with the error that caused them to fail
+	FailWithError chan Failure
+
+	// Closed by Shutdown to stop handing out tasks, and then to stop listening for finishes
+	stopping, stopFinish chan bool
+	// Closed once no more tasks will be handed out
+	elementsDone chan bool
+	// Claim tokens of the tasks handed out and not yet finished or failed
+	inflight map[string]string
+	mu       sync.Mutex
+	// Signalled when a task handed out is finished or failed
+	settled              chan bool
+	stopOnce, finishOnce sync.Once
+	closeErr             error
+	// The listening goroutines, and closed once they have all returned
+	wg   sync.WaitGroup
+	done chan struct{}
+	// Taken by the prefetcher for each task it moves into Doing, and freed once
+	// the task is received from Tasks (or put back). Nil unless Prefetch is set.
+	slots chan bool
+	// How often Shutdown looks for tasks settled directly on the Queue
+	shutdownPoll time.Duration
+}
+
+// Tuning for a Listener. The zero value listens like Listen.
+type ListenerOptions struct {
+	// How many tasks may be claimed (moved into Doing) and not yet received from Tasks.
+	// Tasks are only claimed when there is room, so a slow consumer holds no more
+	// than this many hostage. Higher values trade latency for throughput.
+	// 0 claims the next task as soon as the last is claimed, so up to two can
+	// wait on a busy consumer.
+	Prefetch int
+	// Buffer sizes of Finish, Fail and FailWithError, so handing tasks back
+	// doesn't wait on redis. Tasks still in the buffers count as in hand for Shutdown.
+	FinishBuffer int
+	// Buffer size of Errors
+	ErrorBuffer int
+	// How often Shutdown checks for tasks in hand that were finished or failed
+	// directly on the Queue rather than through the listener's channels.
+	// Defaults to 100ms
+	ShutdownPollInterval time.Duration
 }
 
-// Start a listener
+// Default ListenerOptions.ShutdownPollInterval
+const defaultShutdownPoll = 100 * time.Millisecond
+
+// A task that failed, and why
+type Failure struct {
+	Task Ider
+	Err  error
+}
+
+// Start a listener, decoding tasks like example.
+// Each call starts a new listener; several can listen on a Queue at once.
 func (q *Queue) Listen(example Ider) *Listener {
-	if q.listener == nil {
-		q.listener = NewListener(q, q.Todo.PopPipeListen(q.Doing), example)
+	return q.ListenWithOptions(example, ListenerOptions{})
+}
+
+// Start a listener, decoding tasks like example, tuned by opts
+func (q *Queue) ListenWithOptions(example Ider, opts ListenerOptions) *Listener {
+	if opts.Prefetch > 0 {
+		pf := q.prefetch(opts.Prefetch)
+		l := newListener(q, pf, pf.Elements, pf.Errors, example, opts)
+		l.slots = pf.slots
+		return l
+	}
+	if len(q.Todos) > 1 {
+		pl := q.priorityListen()
+		return newListener(q, pl, pl.Elements, pl.Errors, example, opts)
 	}
-	return q.listener
+	sql := q.Todo.PopPipeListen(q.Doing)
+	return newListener(q, sql, sql.Elements, sql.Errors, example, opts)
 }
 
 func NewListener(rq *Queue, sql *simpleq.Listener, example Ider) *Listener {
+	return newListener(rq, sql, sql.Elements, sql.Errors, example, ListenerOptions{})
+}
+
+func newListener(rq *Queue, closer io.Closer, elements <-chan []byte, errors <-chan error, example Ider, opts ListenerOptions) *Listener {
 	l := &Listener{
-		l:      sql,
-		Tasks:  make(chan Ider),
-		Fail:   make(chan Ider),
-		Finish: make(chan Ider),
-		Errors: make(chan error),
-		rq:     rq,
+		l:        closer,
+		elements: elements,
+		errors:   errors,
+		Tasks:    make(chan Ider),
+		Fail:     make(chan Ider, opts.FinishBuffer),
+		Finish:   make(chan Ider, opts.FinishBuffer),
+		Errors:   make(chan error, opts.ErrorBuffer),
+		rq:       rq,
+
+		FailWithError: make(chan Failure, opts.FinishBuffer),
+
+		stopping:     make(chan bool),
+		stopFinish:   make(chan bool),
+		elementsDone: make(chan bool),
+		inflight:     make(map[string]string),
+		settled:      make(chan bool, 1),
+		shutdownPoll: opts.ShutdownPollInterval,
+		done:         make(chan struct{}),
+	}
+
+	if l.shutdownPoll <= 0 {
+		l.shutdownPoll = defaultShutdownPoll
 	}
 
+	l.wg.Add(3)
 	go l.listenOnError()
 	go l.listenOnFinish()
 	go l.listenOnElements(example)
+
+	go func() {
+		l.wg.Wait()
+		close(l.Errors)
+		close(l.done)
+	}()
+
 	return l
 }
 
+// Stop claiming tasks. Any claimed but not yet handed out are put back onto Todo.
+// Finish, Fail and FailWithError keep working until they are closed by the caller
+// (or Shutdown is called). Safe to call more than once.
 func (l *Listener) Close() error {
-	return l.l.Close()
+	l.stop()
+	return l.closeErr
+}
+
+// Closed once the listener has stopped completely, after Tasks and Errors are closed
+func (l *Listener) Done() <-chan struct{} {
+	return l.done
+}
+
+func (l *Listener) stop() {
+	l.stopOnce.Do(func() {
+		close(l.stopping)
+		l.closeErr = l.l.Close()
+	})
+}
+
+// Stop the listener gracefully. It stops claiming tasks, puts any it has claimed
+// but not handed out back onto Todo, and waits for the tasks it handed out to be
+// finished or failed (through its channels, or directly on the Queue).
+// It returns once the listener is Done, after which its channels must not be used again.
+// If ctx is done first, ctx.Err() is returned and the tasks still in hand are
+// left in Doing (to be reclaimed after ProcessTimeout, if set).
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.stop()
+
+	select {
+	case <-l.elementsDone:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for l.pending() > 0 {
+		select {
+		case <-l.settled:
+		case <-time.After(l.shutdownPoll):
+			if err := l.forgetSettled(); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	l.finishOnce.Do(func() { close(l.stopFinish) })
+
+	select {
+	case <-l.done:
+		return l.closeErr
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Keep the claim on a task from this listener alive while it is being handled.
+func (l *Listener) Heartbeat(task Ider) *Heartbeat {
+	return l.rq.heartbeat(task.Id(), l.leaseOf(task.Id()), l.rq.heartbeatInterval())
 }
 
 func (l *Listener) listenOnError() {
-	for err := range l.l.Errors {
+	defer l.wg.Done()
+	for err := range l.errors {
 		l.Errors <- errorcaller.Err(err)
 	}
-	l.closeErrors()
 }
 
 func (l *Listener) listenOnFinish() {
-	defer l.closeErrors()
+	defer l.wg.Done()
 	for {
+		var task Ider
+		var err error
+
 		select {
 		case t, ok := <-l.Fail:
 			if !ok {
 				return
 			}
-			if err := l.rq.Fail(t); err != nil {
-				l.Errors <- errorcaller.Err(err)
+			task = t
+			_, err = l.rq.failRetry(context.Background(), t, nil, l.leaseOf(t.Id()))
+		case f, ok := <-l.FailWithError:
+			if !ok {
+				return
 			}
+			task = f.Task
+			_, err = l.rq.failRetry(context.Background(), f.Task, f.Err, l.leaseOf(f.Task.Id()))
 		case t, ok := <-l.Finish:
 			if !ok {
 				return
 			}
-			if err := l.rq.Finish(t); err != nil {
-				l.Errors <- errorcaller.Err(err)
-			}
+			task, err = t, l.rq.finish(context.Background(), t, l.leaseOf(t.Id()))
+		case <-l.stopFinish:
+			return
+		}
+
+		if err != nil {
+			l.Errors <- errorcaller.Err(err)
 		}
+		l.settle(task.Id())
 	}
 }
 
 func (l *Listener) listenOnElements(example Ider) {
 	defer func() {
-		l.closeErrors()
 		close(l.Tasks)
+		close(l.elementsDone)
+		l.wg.Done()
 	}()
 
 	typ := reflect.TypeOf(example)
@@ -85,24 +258,253 @@ func (l *Listener) listenOnElements(example Ider) {
 		isPointer = true
 	}
 
-	for id := range l.l.Elements {
-		task := reflect.New(typ).Interface()
-		if err := l.rq.Storage.Get(id, task); err != nil {
-			l.Errors <- errorcaller.Err(err)
-		} else {
+	for id := range l.elements {
+		l.handOut(id, typ, isPointer)
+		l.release()
+	}
+}
+
+// Claim a task moved into Doing and hand it out, or put it back if stopping
+func (l *Listener) handOut(id []byte, typ reflect.Type, isPointer bool) {
+	if l.isStopping() {
+		l.putBack(id)
+		return
+	}
+
+	if expired, err := l.rq.claim(id); err != nil {
+		l.Errors <- errorcaller.Err(err)
+	} else if len(expired) > 0 {
+		return
+	}
 
-			if !isPointer {
-				task = reflect.ValueOf(task).Elem().Interface()
+	task := reflect.New(typ).Interface()
+	if err := l.rq.Storage.Get(id, task); err != nil {
+		l.Errors <- errorcaller.Err(err)
+		return
+	}
+
+	if !isPointer {
+		task = reflect.ValueOf(task).Elem().Interface()
+	}
+
+	l.track(id, l.rq.leaseOf(id))
+	select {
+	case l.Tasks <- task.(Ider):
+	case <-l.stopping:
+		l.settle(id)
+		l.putBack(id)
+	}
+}
+
+// Free the prefetch slot of a task that has been handed out or put back
+func (l *Listener) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+func (l *Listener) isStopping() bool {
+	select {
+	case <-l.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Put a task that was claimed but never handed out back onto Todo
+func (l *Listener) putBack(id []byte) {
+	if err := l.rq.requeue(id, false); err != nil {
+		l.Errors <- errorcaller.Err(err)
+	}
+}
+
+// Record that a task was handed out under a claim token
+func (l *Listener) track(id []byte, token string) {
+	l.mu.Lock()
+	l.inflight[string(id)] = token
+	l.mu.Unlock()
+}
+
+// The claim token of a task handed out, or "" if it isn't in hand
+func (l *Listener) leaseOf(id []byte) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inflight[string(id)]
+}
+
+// Record that a task handed out was finished or failed
+func (l *Listener) settle(id []byte) {
+	l.mu.Lock()
+	delete(l.inflight, string(id))
+	l.mu.Unlock()
+
+	select {
+	case l.settled <- true:
+	default:
+	}
+}
+
+// How many tasks handed out haven't been finished or failed
+func (l *Listener) pending() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.inflight)
+}
+
+// Forget the tasks handed out that were finished or failed on the Queue directly,
+// i.e. that are no longer in Doing according to their Meta
+func (l *Listener) forgetSettled() error {
+	l.mu.Lock()
+	ids := make([]string, 0, len(l.inflight))
+	for id := range l.inflight {
+		ids = append(ids, id)
+	}
+	l.mu.Unlock()
+
+	for _, id := range ids {
+		if m, err := l.rq.Meta([]byte(id)); err != nil {
+			return err
+		} else if m == nil || m.State != StateDoing {
+			l.settle([]byte(id))
+		}
+	}
+	return nil
+}
+
+// Moves tasks by priority onto the Doing queue, like a simpleq.Listener does for a single queue
+type priorityListener struct {
+	Elements chan []byte
+	Errors   chan error
+	stop     chan bool
+}
+
+func (q *Queue) priorityListen() *priorityListener {
+	pl := &priorityListener{
+		Elements: make(chan []byte),
+		Errors:   make(chan error),
+		stop:     make(chan bool),
+	}
+
+	go func() {
+		defer func() {
+			close(pl.Elements)
+			close(pl.Errors)
+		}()
+
+		for {
+			// Don't pop again what the listener puts back while stopping
+			select {
+			case <-pl.stop:
+				return
+			default:
 			}
 
-			l.Tasks <- task.(Ider)
+			id, err := q.popPriority()
+
+			if err != nil {
+				select {
+				case pl.Errors <- err:
+				case <-pl.stop:
+					return
+				}
+			} else if id != nil {
+				// Always send it on: it is already in Doing, and the listener
+				// puts it back if it is stopping
+				pl.Elements <- id
+			} else {
+				select {
+				case <-time.After(q.Cfg.PriorityPollInterval):
+				case <-pl.stop:
+					return
+				}
+			}
 		}
+	}()
+
+	return pl
+}
+
+func (pl *priorityListener) Close() error {
+	close(pl.stop)
+	return nil
+}
+
+// Moves tasks onto the Doing queue only while fewer than a number of them are
+// waiting to be handed out, rather than as soon as the last one is taken
+type prefetcher struct {
+	Elements chan []byte
+	Errors   chan error
+	slots    chan bool
+	stop     chan bool
+}
+
+func (q *Queue) prefetch(n int) *prefetcher {
+	pf := &prefetcher{
+		Elements: make(chan []byte, n),
+		Errors:   make(chan error),
+		slots:    make(chan bool, n),
+		stop:     make(chan bool),
 	}
+
+	go func() {
+		defer func() {
+			close(pf.Elements)
+			close(pf.Errors)
+		}()
+
+		for {
+			select {
+			case pf.slots <- true:
+			case <-pf.stop:
+				return
+			}
+
+			id, err := q.popWait(pf.stop)
+			if err != nil {
+				<-pf.slots
+				select {
+				case pf.Errors <- err:
+				case <-pf.stop:
+					return
+				}
+			} else if id == nil {
+				return
+			} else {
+				// Always send it on, as in priorityListen
+				pf.Elements <- id
+			}
+		}
+	}()
+
+	return pf
 }
 
-func (l *Listener) closeErrors() {
-	l.closeErrorCount += 1
-	if l.closeErrorCount == 3 {
-		close(l.Errors)
+// Block until a task is moved onto Doing, or stop is closed (returning nil).
+// Blocks a second at a time, so it can take up to a second to notice stop.
+func (q *Queue) popWait(stop <-chan bool) ([]byte, error) {
+	for {
+		select {
+		case <-stop:
+			return nil, nil
+		default:
+		}
+
+		var id []byte
+		var err error
+		if len(q.Todos) > 1 {
+			id, err = q.bpopPriority(1)
+		} else {
+			id, err = q.Todo.BPopPipe(q.Doing, 1)
+		}
+
+		if err != nil || id != nil {
+			return id, err
+		}
 	}
 }
+
+func (pf *prefetcher) Close() error {
+	close(pf.stop)
+	return nil
+}
@@ -0,0 +1,190 @@
+package relyq
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestListenerDone(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	l := q.Listen(ArbitraryTask{})
+	go func() {
+		for range l.Errors {
+		}
+	}()
+
+	if err := l.Close(); err != nil {
+		t.Error("Close", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Error("Close twice", err)
+	}
+
+	select {
+	case <-l.Done():
+		t.Error("Done shouldn't be closed while Finish and Fail are open")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(l.Finish)
+
+	select {
+	case <-l.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout waiting for Done")
+	}
+
+	if _, ok := <-l.Tasks; ok {
+		t.Error("Tasks should be closed")
+	}
+	if _, ok := <-l.Errors; ok {
+		t.Error("Errors should be closed")
+	}
+}
+
+func TestMultipleListeners(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	la, lb := q.Listen(ArbitraryTask{}), q.Listen(&TaskStruct{})
+	if la == lb {
+		t.Fatal("Listen should start a new listener each time")
+	}
+
+	const n = 10
+	for i := 0; i < n; i++ {
+		push(t, q, ArbitraryTask{"f": "task"})
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	counts := make(map[*Listener]int)
+	wg.Add(n)
+	for _, l := range []*Listener{la, lb} {
+		go func(l *Listener) {
+			for task := range l.Tasks {
+				mu.Lock()
+				counts[l]++
+				mu.Unlock()
+				l.Finish <- task
+				wg.Done()
+			}
+		}(l)
+	}
+
+	finished := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout waiting for tasks")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	for _, l := range []*Listener{la, lb} {
+		go func(l *Listener) {
+			for range l.Errors {
+			}
+		}(l)
+		if err := l.Shutdown(ctx); err != nil {
+			t.Error("Shutdown", err)
+		}
+	}
+
+	mu.Lock()
+	if counts[la]+counts[lb] != n {
+		t.Error("Expected", n, "tasks, got", counts)
+	}
+	mu.Unlock()
+
+	checkTaskList(t, q, q.Todo)
+	checkTaskList(t, q, q.Doing)
+}
+
+func TestListenerPrefetch(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	const n = 5
+	for i := 0; i < n; i++ {
+		push(t, q, ArbitraryTask{"f": "task"})
+	}
+
+	l := q.ListenWithOptions(ArbitraryTask{}, ListenerOptions{Prefetch: 2, FinishBuffer: n})
+	go func() {
+		for err := range l.Errors {
+			t.Error("Listener", err)
+		}
+	}()
+
+	// Nothing is received, so only Prefetch tasks should be claimed
+	time.Sleep(200 * time.Millisecond)
+	checkLengths(t, q, n-2, 2)
+
+	for i := 0; i < n; i++ {
+		select {
+		case task := <-l.Tasks:
+			l.Finish <- task
+		case <-time.After(3 * time.Second):
+			t.Fatal("Timeout waiting for task", i)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := l.Shutdown(ctx); err != nil {
+		t.Error("Shutdown", err)
+	}
+
+	checkTaskList(t, q, q.Todo)
+	checkTaskList(t, q, q.Doing)
+}
+
+func TestListenerPrefetchShutdown(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	l := q.ListenWithOptions(ArbitraryTask{}, ListenerOptions{Prefetch: 3})
+	go func() {
+		for err := range l.Errors {
+			t.Error("Listener", err)
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		push(t, q, ArbitraryTask{"f": "task"})
+	}
+	time.Sleep(200 * time.Millisecond)
+	checkLengths(t, q, 1, 3)
+
+	// Prefetched tasks that were never received go back onto Todo
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := l.Shutdown(ctx); err != nil {
+		t.Error("Shutdown", err)
+	}
+
+	checkLengths(t, q, 4, 0)
+}
+
+func checkLengths(t *testing.T, q *Queue, todo, doing int) {
+	if els, err := q.Todo.List(); err != nil {
+		t.Error("Todo.List", err)
+	} else if len(els) != todo {
+		t.Error("Expected", todo, "tasks in Todo, got", len(els))
+	}
+	if els, err := q.Doing.List(); err != nil {
+		t.Error("Doing.List", err)
+	} else if len(els) != doing {
+		t.Error("Expected", doing, "tasks in Doing, got", len(els))
+	}
+}
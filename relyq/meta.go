@@ -0,0 +1,153 @@
+package relyq
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"time"
+)
+
+// States of a task, as recorded in its Meta
+const (
+	StateTodo      = "todo"
+	StateDeferred  = "deferred"
+	StateDoing     = "doing"
+	StateRetrying  = "retrying"
+	StateFailed    = "failed"
+	StateDead      = "dead"
+	StateDone      = "done"
+	StateCancelled = "cancelled"
+)
+
+// What relyq knows about a task.
+// It is kept in a hash next to the stored task, so task types don't need to change.
+type Meta struct {
+	// One of the State constants. Empty if unknown (e.g. the task was removed).
+	State string
+	// When the task was pushed
+	EnqueuedAt time.Time
+	// When the task was last moved into Doing, and by which worker (Config.WorkerId)
+	ClaimedAt time.Time
+	Worker    string
+	// How many times the task has been failed
+	Attempts int
+	// When the task was finished, if its Meta was kept (KeepDoneTasks)
+	FinishedAt time.Time
+	// When the task was last failed
+	FailedAt time.Time
+	// Error from the last failed attempt and its type (e.g. "*errors.errorString"),
+	// if it was failed with FailWithError
+	LastError string
+	ErrorType string
+	// Why the task was failed or killed (e.g. ReasonTimeout)
+	Reason string
+	// When the task expires. Zero if it has no deadline.
+	Deadline time.Time
+	// The priority level the task was pushed with, which it goes back onto when
+	// retried, requeued, reclaimed or resurrected
+	Priority int
+}
+
+// Get what relyq knows about a task. Returns nil if nothing is known,
+// such as after a finished task's meta is cleaned up.
+func (q *Queue) Meta(id []byte) (*Meta, error) {
+	fields, err := redis.StringMap(q.do("HGETALL", q.metaKey(id)))
+	if err != nil {
+		return nil, err
+	}
+	return parseMeta(fields)
+}
+
+// Read a meta hash. Returns nil if it is empty.
+func parseMeta(fields map[string]string) (*Meta, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	var err error
+	m := &Meta{
+		State:     fields["state"],
+		Worker:    fields["worker"],
+		LastError: fields["last_error"],
+		ErrorType: fields["error_type"],
+		Reason:    fields["reason"],
+	}
+
+	if m.Attempts, err = atoi(fields["attempts"]); err != nil {
+		return nil, err
+	}
+	if m.Priority, err = atoi(fields["priority"]); err != nil {
+		return nil, err
+	}
+	if m.EnqueuedAt, err = parseMillis(fields["enqueued_at"]); err != nil {
+		return nil, err
+	}
+	if m.ClaimedAt, err = parseMillis(fields["claimed_at"]); err != nil {
+		return nil, err
+	}
+	if m.FinishedAt, err = parseMillis(fields["finished_at"]); err != nil {
+		return nil, err
+	}
+	if m.FailedAt, err = parseMillis(fields["failed_at"]); err != nil {
+		return nil, err
+	}
+	if m.Deadline, err = parseMillis(fields["deadline"]); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Why a task was failed or killed (e.g. ReasonTimeout). Empty if none was recorded.
+func (q *Queue) Reason(id []byte) (string, error) {
+	reason, err := redis.String(q.do("HGET", q.metaKey(id), "reason"))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return reason, err
+}
+
+// How many times a task has been failed
+func (q *Queue) Attempts(id []byte) (int, error) {
+	n, err := redis.Int(q.do("HGET", q.metaKey(id), "attempts"))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return n, err
+}
+
+// Redis key of the hash holding relyq's own data about a task
+func (q *Queue) metaKey(id []byte) string {
+	return q.Cfg.key("meta") + q.Cfg.Delimiter + string(id)
+}
+
+// HMSET arguments recording that a task was pushed into a state, with a deadline unless it is zero
+// and a priority level unless it is 0
+func (q *Queue) pushMeta(id []byte, state string, level int, now, deadline time.Time) []interface{} {
+	args := []interface{}{q.metaKey(id), "state", state, "enqueued_at", toMillis(now)}
+	if !deadline.IsZero() {
+		args = append(args, "deadline", toMillis(deadline))
+	}
+	if level > 0 {
+		args = append(args, "priority", level)
+	}
+	return args
+}
+
+func atoi(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(s)
+}
+
+// Parse a time stored in unix milliseconds. Empty is the zero time.
+func parseMillis(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fromMillis(ms), nil
+}
@@ -0,0 +1,169 @@
+package relyq
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMeta(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.KeepDoneTasks = true
+	cfg.WorkerId = "worker-1"
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	before := time.Now().Add(-time.Second)
+	task := ArbitraryTask{"f": "meta"}
+	push(t, q, task)
+
+	checkMeta(t, q, task.Id(), StateTodo, 0)
+	if m, _ := q.Meta(task.Id()); m == nil || m.EnqueuedAt.Before(before) || !m.ClaimedAt.IsZero() {
+		t.Error("Bad meta after push", m)
+	}
+
+	tp := ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	}
+	checkMeta(t, q, task.Id(), StateDoing, 0)
+	if m, _ := q.Meta(task.Id()); m == nil || m.ClaimedAt.Before(before) || m.Worker != "worker-1" {
+		t.Error("Bad meta after process", m)
+	}
+
+	if err := q.Fail(tp); err != nil {
+		t.Error("Fail", err)
+	}
+	checkMeta(t, q, task.Id(), StateFailed, 1)
+
+	if err := q.Requeue(tp); err != nil {
+		t.Error("Requeue", err)
+	}
+	checkMeta(t, q, task.Id(), StateTodo, 1)
+
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	} else if err := q.Finish(tp); err != nil {
+		t.Error("Finish", err)
+	}
+	checkMeta(t, q, task.Id(), StateDone, 1)
+}
+
+func TestMetaCleanedUp(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "meta"})
+
+	tp := ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	} else if err := q.Finish(tp); err != nil {
+		t.Error("Finish", err)
+	}
+
+	if m, err := q.Meta(tp.Id()); m != nil || err != nil {
+		t.Error("Meta should be gone after finishing", m, err)
+	}
+}
+
+func TestMetaDeferredAndRetrying(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AllowDefer = true
+	cfg.MaxAttempts = 3
+	cfg.RetryBackoff = time.Second
+	cfg.DeferPollInterval = 5 * time.Millisecond
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	task := ArbitraryTask{"f": "later"}
+	if err := q.PushAfter(task, 20*time.Millisecond); err != nil {
+		t.Error("PushAfter", err)
+	}
+	checkMeta(t, q, task.Id(), StateDeferred, 0)
+
+	time.Sleep(50 * time.Millisecond)
+	checkMeta(t, q, task.Id(), StateTodo, 0)
+
+	tp := ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	} else if err := q.Fail(tp); err != nil {
+		t.Error("Fail", err)
+	}
+	checkMeta(t, q, task.Id(), StateRetrying, 1)
+}
+
+func checkMeta(t *testing.T, q *Queue, id []byte, state string, attempts int) {
+	m, err := q.Meta(id)
+	if err != nil {
+		t.Error("Meta", err)
+	} else if m == nil {
+		t.Error("No meta for", string(id))
+	} else if m.State != state || m.Attempts != attempts {
+		t.Error("Expected", state, attempts, "got", m.State, m.Attempts)
+	}
+}
+
+func TestFailWithError(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "broken"})
+
+	tp := ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	} else if err := q.FailWithError(tp, errors.New("bad input")); err != nil {
+		t.Error("FailWithError", err)
+	}
+
+	checkTaskList(t, q, q.Failed, ArbitraryTask{"f": "broken"})
+	m, err := q.Meta(tp.Id())
+	if err != nil || m == nil {
+		t.Error("Meta", m, err)
+		return
+	}
+	if m.LastError != "bad input" || m.ErrorType != "*errors.errorString" || m.FailedAt.IsZero() {
+		t.Error("Error not recorded", m)
+	}
+
+	// A plain Fail clears the last error
+	if err := q.Requeue(tp); err != nil {
+		t.Error("Requeue", err)
+	} else if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	} else if err := q.Fail(tp); err != nil {
+		t.Error("Fail", err)
+	}
+	if m, err := q.Meta(tp.Id()); err != nil || m == nil || m.LastError != "" || m.Attempts != 2 {
+		t.Error("Last error should be cleared", m, err)
+	}
+}
+
+func TestListenFailWithError(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "broken"})
+
+	l := q.Listen(ArbitraryTask{})
+	defer l.Close()
+
+	select {
+	case task := <-l.Tasks:
+		l.FailWithError <- Failure{task, errors.New("bad input")}
+	case err := <-l.Errors:
+		t.Error("Listener error", err)
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Timeout waiting for task")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	checkTaskList(t, q, q.Failed, ArbitraryTask{"f": "broken"})
+	if failed, err := q.Failed.List(); err != nil || len(failed) != 1 {
+		t.Error("Failed list", failed, err)
+	} else if m, err := q.Meta(failed[0]); err != nil || m == nil || m.LastError != "bad input" {
+		t.Error("Error not recorded", m, err)
+	}
+}
@@ -0,0 +1,53 @@
+package relyq
+
+import (
+	"github.com/yanatan16/errorcaller"
+	"time"
+)
+
+// A background loop running a function on an interval until closed
+type poller struct {
+	stop, done chan bool
+}
+
+// Start running fn every interval. Errors are reported on errs.
+func startPoller(interval time.Duration, errs chan error, fn func() error) *poller {
+	p := &poller{
+		stop: make(chan bool),
+		done: make(chan bool),
+	}
+
+	go func() {
+		defer close(p.done)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-tick.C:
+				if err := fn(); err != nil {
+					reportError(errs, errorcaller.Err(err))
+				}
+			}
+		}
+	}()
+
+	return p
+}
+
+// Stop the poller and wait for its current run to end
+func (p *poller) Close() error {
+	close(p.stop)
+	<-p.done
+	return nil
+}
+
+// Send an error without blocking. Errors are dropped if nobody is listening.
+func reportError(errs chan error, err error) {
+	select {
+	case errs <- err:
+	default:
+	}
+}
@@ -0,0 +1,107 @@
+package relyq
+
+import (
+	"context"
+	"fmt"
+	"github.com/Rafflecopter/golang-relyq/scripts"
+	"github.com/garyburd/redigo/redis"
+	"math/rand"
+	"time"
+)
+
+// Push a task onto the Todo queue of a priority level.
+// Higher levels are processed first. Level 0 is the normal Todo queue.
+func (q *Queue) PushPriority(task Ider, level int) error {
+	if level < 0 || level >= len(q.Todos) {
+		return fmt.Errorf("Priority level %d out of range [0, %d).", level, len(q.Todos))
+	}
+	return q.push(context.Background(), task, task.Id(), level, q.defaultDeadline(time.Now()))
+}
+
+// Move the next task by priority onto the Doing queue. Returns nil if all Todo queues are empty.
+func (q *Queue) popPriority() ([]byte, error) {
+	order := q.priorityOrder()
+	args := make([]interface{}, 0, len(order)+2)
+	args = append(args, len(order)+1)
+	for _, level := range order {
+		args = append(args, q.todoKey(level))
+	}
+	args = append(args, q.Cfg.key("doing"))
+
+	conn := q.pool.Get()
+	defer conn.Close()
+
+	id, err := redis.Bytes(scripts.PriorityPopPipe.Do(conn, args...))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return id, err
+}
+
+// Block until a task can be moved by priority onto the Doing queue.
+// Returns nil after timeout_secs (or never, if timeout_secs is 0).
+func (q *Queue) bpopPriority(timeout_secs int) ([]byte, error) {
+	var timeout <-chan time.Time
+	if timeout_secs > 0 {
+		timeout = time.After(time.Duration(timeout_secs) * time.Second)
+	}
+
+	for {
+		if id, err := q.popPriority(); err != nil || id != nil {
+			return id, err
+		}
+
+		select {
+		case <-timeout:
+			return nil, nil
+		case <-time.After(q.Cfg.PriorityPollInterval):
+		}
+	}
+}
+
+// The priority level a task goes back onto, capped at the highest level
+func (q *Queue) levelOf(m *Meta) int {
+	if m.Priority >= len(q.Todos) {
+		return len(q.Todos) - 1
+	}
+	return m.Priority
+}
+
+// The order in which to try the priority levels.
+// Strictly highest first, unless WeightedPriority is set. Then each level is
+// picked to go next with probability proportional to its level plus one.
+func (q *Queue) priorityOrder() []int {
+	order := make([]int, len(q.Todos))
+	for i := range order {
+		order[i] = len(order) - 1 - i
+	}
+
+	if !q.Cfg.WeightedPriority {
+		return order
+	}
+
+	for i := range order {
+		total := 0
+		for _, level := range order[i:] {
+			total += level + 1
+		}
+
+		pick := rand.Intn(total)
+		for j := i; j < len(order); j++ {
+			if pick -= order[j] + 1; pick < 0 {
+				order[i], order[j] = order[j], order[i]
+				break
+			}
+		}
+	}
+
+	return order
+}
+
+// Redis key of a priority level's Todo queue
+func (q *Queue) todoKey(level int) string {
+	if level == 0 {
+		return q.Cfg.key("todo")
+	}
+	return fmt.Sprintf("%s%s%d", q.Cfg.key("todo"), q.Cfg.Delimiter, level)
+}
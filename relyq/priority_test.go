@@ -0,0 +1,178 @@
+package relyq
+
+import (
+	"testing"
+	"time"
+)
+
+func priorityConfig() *Config {
+	cfg := defaultConfig()
+	cfg.PriorityLevels = 3
+	cfg.PriorityPollInterval = 10 * time.Millisecond
+	return cfg
+}
+
+func TestPushPriority(t *testing.T) {
+	q := begin(nil, priorityConfig())
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "backfill"})
+	if err := q.PushPriority(ArbitraryTask{"f": "urgent"}, 2); err != nil {
+		t.Error("PushPriority", err)
+	}
+	if err := q.PushPriority(ArbitraryTask{"f": "normal"}, 1); err != nil {
+		t.Error("PushPriority", err)
+	}
+	if err := q.PushPriority(ArbitraryTask{"f": "bogus"}, 3); err == nil {
+		t.Error("PushPriority should reject out of range levels")
+	}
+
+	for _, f := range []string{"urgent", "normal", "backfill"} {
+		tp := ArbitraryTask{}
+		if ok, err := q.Process(&tp); !ok || err != nil {
+			t.Error("Process", ok, err)
+		} else {
+			checkTaskEqual(t, tp, ArbitraryTask{"f": f})
+		}
+	}
+
+	if ok, err := q.Process(&ArbitraryTask{}); ok || err != nil {
+		t.Error("Process should find nothing", ok, err)
+	}
+}
+
+func TestBProcessPriority(t *testing.T) {
+	q := begin(nil, priorityConfig())
+	defer end(t, q)
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		if err := q.PushPriority(ArbitraryTask{"f": "urgent"}, 2); err != nil {
+			t.Error("PushPriority", err)
+		}
+	}()
+
+	tp := ArbitraryTask{}
+	if err := q.BProcess(1, &tp); err != nil {
+		t.Error("BProcess", err)
+	} else {
+		checkTaskEqual(t, tp, ArbitraryTask{"f": "urgent"})
+	}
+	checkTaskList(t, q, q.Doing, ArbitraryTask{"f": "urgent"})
+}
+
+func TestListenPriority(t *testing.T) {
+	q := begin(nil, priorityConfig())
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "low"})
+	if err := q.PushPriority(ArbitraryTask{"f": "high"}, 2); err != nil {
+		t.Error("PushPriority", err)
+	}
+
+	var example ArbitraryTask
+	l := q.Listen(example)
+
+	for _, f := range []string{"high", "low"} {
+		select {
+		case task := <-l.Tasks:
+			checkTaskEqual(t, task.(ArbitraryTask), ArbitraryTask{"f": f})
+			l.Finish <- task
+		case err := <-l.Errors:
+			t.Error("Listener", err)
+		case <-time.After(500 * time.Millisecond):
+			t.Error("Timeout waiting for task", f)
+		}
+	}
+
+	if err := l.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWeightedPriorityOrder(t *testing.T) {
+	cfg := priorityConfig()
+	cfg.WeightedPriority = true
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	firsts := make([]int, 3)
+	for i := 0; i < 600; i++ {
+		order := q.priorityOrder()
+		if len(order) != 3 {
+			t.Fatal("Bad order", order)
+		}
+		firsts[order[0]]++
+	}
+
+	// Weights are 1, 2 and 3
+	if firsts[0] == 0 || firsts[0] >= firsts[1] || firsts[1] >= firsts[2] {
+		t.Error("Weighted order isn't weighted", firsts)
+	}
+}
+
+func TestPriorityKept(t *testing.T) {
+	cfg := priorityConfig()
+	cfg.MaxAttempts = 5
+	cfg.RetryBackoff = time.Millisecond
+	cfg.DeferPollInterval = 5 * time.Millisecond
+	cfg.UseDeadQueue = true
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	task := ArbitraryTask{"f": "urgent"}
+	if err := q.PushPriority(task, 2); err != nil {
+		t.Fatal("PushPriority", err)
+	}
+	if m, err := q.Meta(task.Id()); err != nil || m.Priority != 2 {
+		t.Error("Meta should record the priority level", m, err)
+	}
+
+	process := func() ArbitraryTask {
+		tp := ArbitraryTask{}
+		if ok, err := q.Process(&tp); !ok || err != nil {
+			t.Fatal("Process", ok, err)
+		}
+		return tp
+	}
+	backOnLevel := func(what string) {
+		if ids, err := q.Todos[2].List(); err != nil || len(ids) != 1 {
+			t.Error(what, "should go back onto level 2", len(ids), err)
+		}
+		checkTaskList(t, q, q.Todo)
+	}
+
+	tp := process()
+	if err := q.Fail(tp); err != nil {
+		t.Error("Fail", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	backOnLevel("Retried task")
+
+	process()
+	if _, err := q.reclaim(time.Now().Add(time.Hour)); err != nil {
+		t.Error("reclaim", err)
+	}
+	backOnLevel("Reclaimed task")
+
+	tp = process()
+	if err := q.Requeue(tp); err != nil {
+		t.Error("Requeue", err)
+	}
+	backOnLevel("Requeued task")
+
+	process()
+	if n, err := q.RequeueAll(q.Doing); n != 1 || err != nil {
+		t.Error("RequeueAll", n, err)
+	}
+	backOnLevel("Task requeued with RequeueAll")
+
+	tp = process()
+	if err := q.Kill(tp, "bad"); err != nil {
+		t.Error("Kill", err)
+	}
+	if err := q.Resurrect(tp.Id()); err != nil {
+		t.Error("Resurrect", err)
+	}
+	backOnLevel("Resurrected task")
+}
@@ -0,0 +1,110 @@
+package relyq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Rafflecopter/golang-relyq/scripts"
+	"github.com/garyburd/redigo/redis"
+	"github.com/yanatan16/errorcaller"
+	"github.com/yanatan16/gowaiter"
+	"time"
+)
+
+// Returned when pushing a recurring task on a queue without AllowRecur
+var ErrRecurNotAllowed = errors.New("relyq: recurring tasks are not enabled (Config.AllowRecur)")
+
+// Push a task that recurs every interval, starting one interval from now.
+// The task is stored as a template; each time it comes due a copy of it
+// with a fresh id is pushed onto the Todo queue. The copy's id is the
+// template id and the due time joined by the Delimiter.
+// Templates are copied by decoding them into an ArbitraryTask and setting
+// Cfg.IdField, so the Storage marshaller must support decoding into a map.
+func (q *Queue) PushRecurring(task Ider, interval time.Duration) error {
+	if !q.Cfg.AllowRecur {
+		return ErrRecurNotAllowed
+	}
+
+	ms := int64(interval / time.Millisecond)
+	if ms <= 0 {
+		return fmt.Errorf("Recurring interval %s must be at least 1ms.", interval)
+	}
+
+	id := task.Id()
+	w := waiter.New(2)
+
+	go func() {
+		if err := q.Storage.Set(task, id); err != nil {
+			w.Errors <- err
+		}
+		w.Done <- true
+	}()
+
+	go func() {
+		ref := fmt.Sprintf("%s|%d", id, ms)
+		if _, err := q.do("ZADD", q.Cfg.key("recurring"), toMillis(time.Now())+ms, ref); err != nil {
+			w.Errors <- err
+		}
+		w.Done <- true
+	}()
+
+	return w.Wait()
+}
+
+// Stop a recurring task and delete its template from storage.
+// Executions already pushed onto the Todo queue are not affected.
+// Returns false if no recurring task had that id.
+func (q *Queue) CancelRecurring(id []byte) (bool, error) {
+	if !q.Cfg.AllowRecur {
+		return false, ErrRecurNotAllowed
+	}
+
+	conn := q.pool.Get()
+	n, err := redis.Int(scripts.RecurRemove.Do(conn, q.Cfg.key("recurring"), id))
+	conn.Close()
+
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	return true, q.deleteTask(id)
+}
+
+// Push a fresh execution of each recurring task that has come due.
+// Their next runs are already scheduled, so one that fails doesn't stop the rest:
+// its error is reported on Errors instead.
+func (q *Queue) pullRecurring(now time.Time) error {
+	conn := q.pool.Get()
+	reply, err := redis.Values(scripts.RecurPull.Do(conn, q.Cfg.key("recurring"), toMillis(now)))
+	conn.Close()
+
+	if err != nil {
+		return err
+	}
+
+	for len(reply) > 0 {
+		var id []byte
+		var due int64
+		if reply, err = redis.Scan(reply, &id, &due); err != nil {
+			return err
+		}
+
+		if err := q.pushExecution(id, due, now); err != nil {
+			reportError(q.Errors, errorcaller.Err(fmt.Errorf("Recurring task %s missed a run: %s", id, err)))
+		}
+	}
+
+	return nil
+}
+
+// Push an execution of a recurring task that was due at a time (in milliseconds)
+func (q *Queue) pushExecution(id []byte, due int64, now time.Time) error {
+	template := ArbitraryTask{}
+	if err := q.Storage.Get(id, &template); err != nil {
+		return err
+	}
+
+	execId := fmt.Sprintf("%s%s%d", id, q.Cfg.Delimiter, due)
+	template[q.Cfg.IdField] = execId
+	return q.push(context.Background(), template, []byte(execId), 0, q.defaultDeadline(now))
+}
@@ -0,0 +1,140 @@
+package relyq
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPushRecurring(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AllowRecur = true
+	cfg.RecurPollInterval = 10 * time.Millisecond
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	task := ArbitraryTask{"f": "report"}
+	if err := q.PushRecurring(task, 40*time.Millisecond); err != nil {
+		t.Error("PushRecurring", err)
+	}
+
+	checkTaskList(t, q, q.Todo)
+	time.Sleep(100 * time.Millisecond)
+
+	list, err := q.Todo.List()
+	if err != nil {
+		t.Error("List", err)
+	} else if len(list) < 2 {
+		t.Error("Expected at least 2 executions, got", len(list))
+	}
+
+	for _, id := range list {
+		if !strings.HasPrefix(string(id), string(task.Id())+cfg.Delimiter) {
+			t.Error("Execution id should be derived from the template id", string(id))
+		}
+
+		el := ArbitraryTask{}
+		if err := q.Storage.Get(id, &el); err != nil {
+			t.Error("Storage.Get", err)
+		} else {
+			checkTaskEqual(t, el, ArbitraryTask{"f": "report"})
+		}
+	}
+
+	if ok, err := q.CancelRecurring(task.Id()); !ok || err != nil {
+		t.Error("CancelRecurring", ok, err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	after, _ := q.Todo.List()
+	time.Sleep(100 * time.Millisecond)
+	if later, _ := q.Todo.List(); len(later) != len(after) {
+		t.Error("Cancelled task still recurring", len(after), len(later))
+	}
+
+	if ok, err := q.CancelRecurring(task.Id()); ok || err != nil {
+		t.Error("CancelRecurring twice", ok, err)
+	}
+}
+
+func TestRecurringDueTime(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AllowRecur = true
+	cfg.RecurPollInterval = time.Hour
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	task := ArbitraryTask{"f": "report"}
+	if err := q.PushRecurring(task, time.Hour); err != nil {
+		t.Error("PushRecurring", err)
+	}
+	due, err := redis.Int64(q.do("ZSCORE", q.Cfg.key("recurring"), fmt.Sprintf("%s|%d", task.Id(), 3600000)))
+	if err != nil {
+		t.Fatal("ZSCORE", err)
+	}
+
+	// Pulled late, twice: each execution is named for when it was due, not when it was pulled
+	now := time.Now().Add(3 * time.Hour)
+	for i := 0; i < 2; i++ {
+		if err := q.pullRecurring(now); err != nil {
+			t.Error("pullRecurring", err)
+		}
+	}
+
+	list, err := q.Todo.List()
+	if err != nil || len(list) != 2 {
+		t.Fatal("Expected 2 executions", len(list), err)
+	}
+	for i, id := range [][]byte{list[1], list[0]} {
+		expect := fmt.Sprintf("%s%s%d", task.Id(), cfg.Delimiter, due+int64(i)*3600000)
+		if string(id) != expect {
+			t.Error("Execution id should have its due time", string(id), expect)
+		}
+	}
+}
+
+func TestRecurNotAllowed(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	if err := q.PushRecurring(ArbitraryTask{}, time.Second); err != ErrRecurNotAllowed {
+		t.Error("Expected ErrRecurNotAllowed", err)
+	}
+}
+
+func TestPullRecurringKeepsGoing(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AllowRecur = true
+	cfg.RecurPollInterval = time.Hour
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	broken, ok := ArbitraryTask{"id": "broken"}, ArbitraryTask{"id": "ok"}
+	for _, task := range []ArbitraryTask{broken, ok} {
+		if err := q.PushRecurring(task, 10*time.Millisecond); err != nil {
+			t.Error("PushRecurring", err)
+		}
+	}
+	if err := q.Storage.Del(broken.Id()); err != nil {
+		t.Error("Del", err)
+	}
+
+	if err := q.pullRecurring(time.Now().Add(20 * time.Millisecond)); err != nil {
+		t.Error("pullRecurring", err)
+	}
+
+	select {
+	case err := <-q.Errors:
+		if !strings.Contains(err.Error(), "broken") {
+			t.Error("Expected an error about the broken task", err)
+		}
+	default:
+		t.Error("Expected the broken task's error on Errors")
+	}
+
+	if list, err := q.Todo.List(); err != nil || len(list) != 1 {
+		t.Error("The other task should still run", list, err)
+	}
+}
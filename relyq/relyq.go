@@ -2,20 +2,42 @@
 package relyq
 
 import (
+	"context"
 	"fmt"
+	"github.com/Rafflecopter/golang-relyq/scripts"
 	"github.com/Rafflecopter/golang-simpleq/simpleq"
 	"github.com/garyburd/redigo/redis"
 	"github.com/yanatan16/gowaiter"
 	"io"
+	"os"
+	"sync"
+	"time"
 )
 
 // A reliable redis-backed queue
 type Queue struct {
 	// The underlying simpleqs
 	Todo, Doing, Done, Failed *simpleq.Queue
-	Storage                   Storage
-	Cfg                       *Config
-	listener                  *Listener
+	// Todo queues by priority level, lowest first. Todos[0] is Todo.
+	Todos []*simpleq.Queue
+	// Tasks that have been given up on. Nil unless UseDeadQueue is set.
+	Dead *simpleq.Queue
+	// Tasks waiting to be moved onto Todo. Nil unless AllowDefer is set.
+	Deferred *Deferred
+	// Failed tasks waiting to be retried. Nil unless MaxAttempts is more than 1.
+	Retrying *Deferred
+	Storage  Storage
+	Cfg      *Config
+	// Errors from background processes (such as moving deferred tasks).
+	// Errors are dropped if this channel is not being read.
+	Errors  chan error
+	pool    *redis.Pool
+	atomic  RedisStorage
+	pollers []io.Closer
+
+	// Claim tokens of the tasks claimed through this Queue, by id
+	leases  map[string]string
+	leaseMu sync.Mutex
 }
 
 // Configuration for Relyq
@@ -27,12 +49,76 @@ type Config struct {
 	IdField string
 	// Redis delimeter. Defaults to ":"
 	Delimiter string
+	// Number of priority levels for the Todo queue
+	// Defaults to 1
+	PriorityLevels int
+	// Give lower priority levels a weighted chance of going first,
+	// instead of always draining higher levels first
+	// Defaults to false
+	WeightedPriority bool
+	// How often blocking calls check the Todo queues when there are multiple priority levels
+	// Defaults to 100 milliseconds
+	PriorityPollInterval time.Duration
 	// Clean finish (i.e. no Done queue)
 	// Defaults to false
 	UseDoneQueue bool
 	// Should we keep the task stored after they are done?
 	// Defaults to false
 	KeepDoneTasks bool
+	// Reject pushes of tasks whose ids are already pending (in Todo, Doing,
+	// Deferred or Retrying) with ErrDuplicate
+	// Defaults to false
+	UniqueTasks bool
+	// Keep a Dead queue of tasks that have been given up on
+	// (killed or out of retries), separate from Failed
+	// Defaults to false
+	UseDeadQueue bool
+	// Allow deferred tasks with PushAt and PushAfter
+	// Defaults to false
+	AllowDefer bool
+	// How often to move deferred and retrying tasks onto the Todo queue
+	// Defaults to 1 second
+	DeferPollInterval time.Duration
+	// Allow recurring tasks with PushRecurring
+	// Defaults to false
+	AllowRecur bool
+	// How often to check for recurring tasks that are due
+	// Defaults to 1 second
+	RecurPollInterval time.Duration
+	// How long a task may stay in Doing before it is reclaimed
+	// Defaults to 0 (never reclaim)
+	ProcessTimeout time.Duration
+	// Move timed out tasks to Failed instead of back to Todo
+	// Defaults to false
+	FailOnTimeout bool
+	// How often to check for timed out tasks
+	// Defaults to 1 second
+	TimeoutPollInterval time.Duration
+	// Check task deadlines before handing tasks to workers
+	// Defaults to false (true if DefaultTTL is set)
+	UseDeadlines bool
+	// Deadline for every task, counted from when it is pushed (or deferred to)
+	// Defaults to 0 (no deadline)
+	DefaultTTL time.Duration
+	// How many times a task is attempted before Fail moves it to Failed
+	// Defaults to 0 (Fail always moves the task to Failed)
+	MaxAttempts int
+	// Backoff before the first retry. Doubles with each attempt.
+	// Defaults to 1 second
+	RetryBackoff time.Duration
+	// Longest backoff between retries
+	// Defaults to 1 hour
+	MaxRetryBackoff time.Duration
+	// How much of the Done and Failed queues to keep. Trimmed tasks are deleted from storage.
+	// Defaults to keeping everything
+	DoneRetention   Retention
+	FailedRetention Retention
+	// How often to trim the Done and Failed queues
+	// Defaults to 1 minute
+	RetentionPollInterval time.Duration
+	// Identifies this process as the worker that claimed a task, in its Meta
+	// Defaults to hostname:pid
+	WorkerId string
 }
 
 // A useful alias for a task
@@ -53,39 +139,135 @@ type Storage interface {
 	io.Closer
 }
 
+// Size of the Queue.Errors buffer
+const errorBuffer = 10
+
 // Create a reliable queue
 func New(pool *redis.Pool, storage Storage, cfg *Config) *Queue {
 	cfg.Defaults()
 
 	rq := &Queue{
-		Todo:    simpleq.New(pool, cfg.Prefix+cfg.Delimiter+"todo"),
-		Doing:   simpleq.New(pool, cfg.Prefix+cfg.Delimiter+"doing"),
-		Failed:  simpleq.New(pool, cfg.Prefix+cfg.Delimiter+"failed"),
+		Todo:    simpleq.New(pool, cfg.key("todo")),
+		Doing:   simpleq.New(pool, cfg.key("doing")),
+		Failed:  simpleq.New(pool, cfg.key("failed")),
 		Storage: storage,
 		Cfg:     cfg,
+		Errors:  make(chan error, errorBuffer),
+		pool:    pool,
+		leases:  make(map[string]string),
+	}
+
+	if rs, ok := storage.(RedisStorage); ok && rs.Pool() == pool {
+		rq.atomic = rs
+	}
+
+	rq.Todos = []*simpleq.Queue{rq.Todo}
+	for level := 1; level < cfg.PriorityLevels; level++ {
+		rq.Todos = append(rq.Todos, simpleq.New(pool, rq.todoKey(level)))
 	}
 
 	if cfg.UseDoneQueue {
-		rq.Done = simpleq.New(pool, cfg.Prefix+cfg.Delimiter+"done")
+		rq.Done = simpleq.New(pool, cfg.key("done"))
+	}
+
+	if cfg.UseDeadQueue {
+		rq.Dead = simpleq.New(pool, cfg.key("dead"))
+	}
+
+	var unique string
+	if cfg.UniqueTasks {
+		unique = cfg.key("unique")
+	}
+
+	if cfg.AllowDefer {
+		rq.Deferred = &Deferred{pool: pool, key: cfg.key("deferred"), unique: unique, meta: rq.metaKey(nil)}
+		rq.pollers = append(rq.pollers, startPoller(cfg.DeferPollInterval, rq.Errors, func() error {
+			return rq.Deferred.moveTo(rq, time.Now())
+		}))
+	}
+
+	if cfg.MaxAttempts > 1 {
+		rq.Retrying = &Deferred{pool: pool, key: cfg.key("retrying"), unique: unique, meta: rq.metaKey(nil)}
+		rq.pollers = append(rq.pollers, startPoller(cfg.DeferPollInterval, rq.Errors, func() error {
+			return rq.Retrying.moveTo(rq, time.Now())
+		}))
+	}
+
+	if cfg.AllowRecur {
+		rq.pollers = append(rq.pollers, startPoller(cfg.RecurPollInterval, rq.Errors, func() error {
+			return rq.pullRecurring(time.Now())
+		}))
+	}
+
+	if cfg.ProcessTimeout > 0 {
+		rq.pollers = append(rq.pollers, startPoller(cfg.TimeoutPollInterval, rq.Errors, func() error {
+			_, err := rq.reclaim(time.Now())
+			return err
+		}))
+	}
+
+	if (cfg.UseDoneQueue && !cfg.DoneRetention.IsZero()) || !cfg.FailedRetention.IsZero() {
+		rq.pollers = append(rq.pollers, startPoller(cfg.RetentionPollInterval, rq.Errors, rq.trimAll))
 	}
 
 	return rq
 }
 
 // Push a task onto the queue
+// If DefaultTTL is set, the task expires after it.
 func (q *Queue) Push(task Ider) error {
-	id := task.Id()
+	return q.PushContext(context.Background(), task)
+}
+
+// Push a task onto the queue, giving up once ctx is done
+func (q *Queue) PushContext(ctx context.Context, task Ider) error {
+	return q.push(ctx, task, task.Id(), 0, q.defaultDeadline(time.Now()))
+}
+
+// Push a task onto a priority level's todo list, with a deadline unless it is zero
+// Its meta records when it was pushed.
+func (q *Queue) push(ctx context.Context, task interface{}, id []byte, level int, deadline time.Time) error {
+	if q.Cfg.UniqueTasks {
+		return q.pushUnique(ctx, task, id, q.todoKey(level), "", level, deadline)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if q.atomic != nil {
+		val, err := q.atomic.Marshal(task)
+		if err != nil {
+			return err
+		}
+
+		conn, err := q.connContext(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		conn.Send("MULTI")
+		conn.Send("SET", q.atomic.Key(id), val)
+		conn.Send("HMSET", q.pushMeta(id, StateTodo, level, time.Now(), deadline)...)
+		conn.Send("LPUSH", q.todoKey(level), id)
+		_, err = conn.Do("EXEC")
+		return err
+	}
+
 	w := waiter.New(2)
 
 	go func() {
-		if err := q.Storage.Set(task, id); err != nil {
+		if err := q.setTask(ctx, task, id); err != nil {
 			w.Errors <- err
 		}
 		w.Done <- true
 	}()
 
 	go func() {
-		if _, err := q.Todo.Push(id); err != nil {
+		if _, err := q.doContext(ctx, "HMSET", q.pushMeta(id, StateTodo, level, time.Now(), deadline)...); err != nil {
+			w.Errors <- err
+		} else if _, err := q.Todos[level].Push(id); err != nil {
 			w.Errors <- err
 		}
 		w.Done <- true
@@ -95,114 +277,204 @@ func (q *Queue) Push(task Ider) error {
 }
 
 // Move the next task to the Doing queue. Will decode into task. Returns ok as false if nothing happened
+// With multiple priority levels, the highest non-empty level is processed first.
+// Expired tasks are skipped.
 func (q *Queue) Process(task Ider) (ok bool, err error) {
-	id, err := q.Todo.PopPipe(q.Doing)
-	if err != nil {
-		return false, err
-	} else if id == nil {
-		return false, nil
-	}
+	return q.ProcessContext(context.Background(), task)
+}
+
+// Process the next task, unless ctx is done first.
+// Once a task is popped, it is claimed and read regardless of ctx.
+func (q *Queue) ProcessContext(ctx context.Context, task Ider) (ok bool, err error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		var id []byte
+		if len(q.Todos) > 1 {
+			id, err = q.popPriority()
+		} else {
+			id, err = q.Todo.PopPipe(q.Doing)
+		}
+
+		if err != nil {
+			return false, err
+		} else if id == nil {
+			return false, nil
+		}
 
-	err = q.Storage.Get(id, task)
-	return err == nil, err
+		if expired, err := q.claim(id); err != nil {
+			return false, err
+		} else if len(expired) > 0 {
+			continue
+		}
+
+		// It's claimed now, so read it even if ctx is done, rather than strand it in Doing
+		err = q.getTask(context.Background(), id, task)
+		return err == nil, err
+	}
 }
 
-// Block and process the next task.
+// Block and process the next task. Returns redis.ErrNil on timeout.
+// A timeout of 0 blocks forever.
+// Expired tasks are skipped.
 func (q *Queue) BProcess(timeout_secs int, task Ider) error {
-	id, err := q.Todo.BPopPipe(q.Doing, timeout_secs)
-	if err != nil {
-		return err
+	if timeout_secs <= 0 {
+		return q.BProcessContext(context.Background(), task)
 	}
 
-	err = q.Storage.Get(id, task)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout_secs)*time.Second)
+	defer cancel()
+
+	err := q.BProcessContext(ctx, task)
+	if err == context.DeadlineExceeded {
+		return redis.ErrNil
+	}
 	return err
 }
 
+// Block and process the next task until ctx is done, returning ctx.Err() then.
+// Blocks a second at a time, so it can take up to a second to notice ctx is done.
+// A task popped meanwhile is still claimed and read, and returned without an error.
+// Expired tasks are skipped.
+func (q *Queue) BProcessContext(ctx context.Context, task Ider) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var id []byte
+		var err error
+		if len(q.Todos) > 1 {
+			id, err = q.bpopPriority(1)
+		} else {
+			id, err = q.Todo.BPopPipe(q.Doing, 1)
+		}
+
+		if err != nil {
+			return err
+		} else if id == nil {
+			continue
+		}
+
+		if expired, err := q.claim(id); err != nil {
+			return err
+		} else if len(expired) > 0 {
+			continue
+		}
+
+		// It's claimed now, so read it even if ctx is done, rather than strand it in Doing
+		return q.getTask(context.Background(), id, task)
+	}
+}
+
 // Move a task to the Done queue if in use
 // If a task is not in use, delete if CleanFinishKeepStorage is false
 // Sometimes a task is in the Failed queue already (maybe timeout) so we check there if not in Finish
 func (q *Queue) Finish(task Ider) error {
+	return q.FinishContext(context.Background(), task)
+}
+
+// Finish a task, giving up once ctx is done
+func (q *Queue) FinishContext(ctx context.Context, task Ider) error {
+	return q.finish(ctx, task, q.leaseOf(task.Id()))
+}
+
+// Finish a task, if its claim token (when given) is still current
+func (q *Queue) finish(ctx context.Context, task Ider, token string) error {
 	id := task.Id()
-	w := waiter.New(2)
 
-	go func() {
-		if q.Cfg.KeepDoneTasks {
-			if err := q.Storage.Set(task, id); err != nil {
-				w.Errors <- err
-			}
-		} else {
-			if err := q.Storage.Del(id); err != nil {
-				w.Errors <- err
-			}
-		}
-		w.Done <- true
-	}()
+	var keep interface{}
+	if q.Cfg.KeepDoneTasks {
+		keep = task
+	}
 
-	go func() {
-		if q.Cfg.UseDoneQueue {
-			if n, err := q.Doing.SPullPipe(q.Done, id); err != nil {
-				w.Errors <- err
-			} else if n == 0 {
-				if n, err := q.Failed.SPullPipe(q.Done, id); err != nil {
-					w.Errors <- err
-				} else if n == 0 {
-					w.Errors <- fmt.Errorf("Task %s not found in Doing or Failed queues.", id)
-				}
-			}
-		} else {
-			if n, err := q.Doing.Pull(id); err != nil {
-				w.Errors <- err
-			} else if n == 0 {
-				if n, err := q.Failed.Pull(id); err != nil {
-					w.Errors <- err
-				} else if n == 0 {
-					w.Errors <- fmt.Errorf("Task %s not found in Doing or Failed queues.", id)
-				}
-			}
-		}
-		w.Done <- true
-	}()
+	n, err := redis.Int(q.transition(ctx, scripts.Finish, id, keep,
+		[]interface{}{q.Cfg.key("doing"), q.Cfg.key("failed"), q.Cfg.key("done"), q.Cfg.key("claims"), q.metaKey(id), q.Cfg.key("unique")},
+		id, flag(q.Cfg.UseDoneQueue), flag(!q.Cfg.KeepDoneTasks), toMillis(time.Now()), token))
 
-	return w.Wait()
+	if err != nil {
+		return err
+	}
+
+	if n == -1 {
+		return ErrLeaseLost
+	}
+
+	q.forgetLease(id, token)
+	if n == 0 {
+		return fmt.Errorf("Task %s not found in Doing or Failed queues.", id)
+	}
+	return nil
 }
 
 // Move a task to the Failed queue
+// If MaxAttempts is set and the task has attempts left, it is retried after a backoff instead.
+// Once out of attempts, it goes to the Dead queue if UseDeadQueue is set.
 func (q *Queue) Fail(task Ider) error {
-	id := task.Id()
-	w := waiter.New(2)
+	return q.FailContext(context.Background(), task)
+}
 
-	go func() {
-		if err := q.Storage.Set(task, id); err != nil {
-			w.Errors <- err
-		}
-		w.Done <- true
-	}()
+// Fail a task, giving up once ctx is done
+func (q *Queue) FailContext(ctx context.Context, task Ider) error {
+	_, err := q.failRetry(ctx, task, nil, q.leaseOf(task.Id()))
+	return err
+}
 
-	go func() {
-		if n, err := q.Doing.SPullPipe(q.Failed, id); err != nil {
-			w.Errors <- err
-		} else if n == 0 {
-			w.Errors <- fmt.Errorf("Task %s not found in Doing queue.", id)
-		}
-		w.Done <- true
-	}()
+// Fail a task, recording the error that caused it.
+// The error's message and type, and when it happened, can be read back with Meta.
+func (q *Queue) FailWithError(task Ider, cause error) error {
+	return q.FailWithErrorContext(context.Background(), task, cause)
+}
 
-	return w.Wait()
+// Fail a task with the error that caused it, giving up once ctx is done
+func (q *Queue) FailWithErrorContext(ctx context.Context, task Ider, cause error) error {
+	_, err := q.failRetry(ctx, task, cause, q.leaseOf(task.Id()))
+	return err
 }
 
 // Remove a task from a queue
 // If dontDelete (single extra arg) is true, then no delete call will be done for the task
 func (q *Queue) Remove(subq *simpleq.Queue, task Ider, keepInStorage ...bool) error {
+	id := task.Id()
+	keep := len(keepInStorage) > 0 && keepInStorage[0]
+
+	subqKey, ok := q.keyOf(subq)
+	if !ok {
+		return q.removeFrom(subq, task, keep)
+	}
+
+	var keepTask interface{}
+	if keep {
+		keepTask = task
+	}
+
+	n, err := redis.Int(q.transition(context.Background(), scripts.Remove, id, keepTask,
+		[]interface{}{subqKey, q.Cfg.key("claims"), q.metaKey(id), q.Cfg.key("unique")},
+		id, flag(!keep), flag(q.isPending(subq))))
+
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("Task %s not found in queue.", id)
+	}
+	q.dropLease(id)
+	return nil
+}
+
+// Remove a task from a simpleq that isn't one of the queue's own
+func (q *Queue) removeFrom(subq *simpleq.Queue, task Ider, keep bool) error {
 	id := task.Id()
 	w := waiter.New(2)
 
 	go func() {
-		if len(keepInStorage) > 0 && keepInStorage[0] {
+		if keep {
 			if err := q.Storage.Set(task, id); err != nil {
 				w.Errors <- err
 			}
 		} else {
-			if err := q.Storage.Del(id); err != nil {
+			if err := q.deleteTask(id); err != nil {
 				w.Errors <- err
 			}
 		}
@@ -223,12 +495,19 @@ func (q *Queue) Remove(subq *simpleq.Queue, task Ider, keepInStorage ...bool) er
 
 // End the queue
 func (q *Queue) Close() error {
-	w := waiter.New(5)
+	for _, p := range q.pollers {
+		p.Close()
+	}
 
-	w.Close(q.Todo)
+	w := waiter.New(5 + len(q.Todos))
+
+	for _, todo := range q.Todos {
+		w.Close(todo)
+	}
 	w.Close(q.Doing)
 	w.Close(q.Failed)
 	w.Close(q.Done)
+	w.Close(q.Dead)
 	w.Close(q.Storage)
 
 	return w.Wait()
@@ -246,4 +525,64 @@ func (cfg *Config) Defaults() {
 	if cfg.Delimiter == "" {
 		cfg.Delimiter = ":"
 	}
+
+	if cfg.DefaultTTL > 0 {
+		cfg.UseDeadlines = true
+	}
+
+	if cfg.PriorityLevels < 1 {
+		cfg.PriorityLevels = 1
+	}
+
+	if cfg.PriorityPollInterval == 0 {
+		cfg.PriorityPollInterval = 100 * time.Millisecond
+	}
+
+	if cfg.DeferPollInterval == 0 {
+		cfg.DeferPollInterval = time.Second
+	}
+
+	if cfg.RetryBackoff == 0 {
+		cfg.RetryBackoff = time.Second
+	}
+
+	if cfg.MaxRetryBackoff == 0 {
+		cfg.MaxRetryBackoff = time.Hour
+	}
+
+	if cfg.RecurPollInterval == 0 {
+		cfg.RecurPollInterval = time.Second
+	}
+
+	if cfg.TimeoutPollInterval == 0 {
+		cfg.TimeoutPollInterval = time.Second
+	}
+
+	if cfg.RetentionPollInterval == 0 {
+		cfg.RetentionPollInterval = time.Minute
+	}
+
+	if cfg.WorkerId == "" {
+		host, _ := os.Hostname()
+		cfg.WorkerId = fmt.Sprintf("%s:%d", host, os.Getpid())
+	}
+}
+
+// Delete a task from storage along with relyq's data about it
+func (q *Queue) deleteTask(id []byte) error {
+	if _, err := q.do("DEL", q.metaKey(id)); err != nil {
+		return err
+	}
+	return q.Storage.Del(id)
+}
+
+func (q *Queue) do(cmd string, args ...interface{}) (interface{}, error) {
+	conn := q.pool.Get()
+	defer conn.Close()
+	return conn.Do(cmd, args...)
+}
+
+// Redis key name for one of the queue's structures
+func (cfg *Config) key(name string) string {
+	return cfg.Prefix + cfg.Delimiter + name
 }
@@ -519,6 +519,15 @@ func begin(s Storage, c *Config) *Queue {
 	if q.Done != nil {
 		q.Done.Clear()
 	}
+	if q.Dead != nil {
+		q.Dead.Clear()
+	}
+	if q.Deferred != nil {
+		q.Deferred.Clear()
+	}
+	if q.Retrying != nil {
+		q.Retrying.Clear()
+	}
 	return q
 }
 
@@ -0,0 +1,55 @@
+package relyq
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Rafflecopter/golang-relyq/scripts"
+	"github.com/Rafflecopter/golang-simpleq/simpleq"
+	"github.com/garyburd/redigo/redis"
+)
+
+// Move a task from the Failed (or Doing) queue back onto the Todo queue.
+// Storage is left as it is.
+// If reset (single extra arg) is true, its attempts and reason are cleared too.
+func (q *Queue) Requeue(task Ider, reset ...bool) error {
+	return q.requeue(task.Id(), len(reset) > 0 && reset[0])
+}
+
+func (q *Queue) requeue(id []byte, reset bool) error {
+	conn := q.pool.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(scripts.Requeue.Do(conn,
+		q.Cfg.key("failed"), q.Cfg.key("doing"), q.Cfg.key("todo"), q.Cfg.key("claims"), q.metaKey(id), q.Cfg.key("unique"),
+		id, flag(reset), flag(q.Cfg.UniqueTasks), q.Cfg.Delimiter, q.Cfg.PriorityLevels))
+
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("Task %s not found in Failed or Doing queues.", id)
+	}
+	q.dropLease(id)
+	return nil
+}
+
+// Move every task in a queue (such as Failed or Doing) back onto the Todo queue.
+// Returns the number of tasks moved.
+// If reset (single extra arg) is true, their attempts and reasons are cleared too.
+func (q *Queue) RequeueAll(subq *simpleq.Queue, reset ...bool) (int, error) {
+	key, ok := q.keyOf(subq)
+	if !ok {
+		return 0, errors.New("Can only requeue from the queue's own simpleqs.")
+	}
+	for _, todo := range q.Todos {
+		if subq == todo {
+			return 0, errors.New("Can't requeue from a Todo queue.")
+		}
+	}
+
+	conn := q.pool.Get()
+	defer conn.Close()
+
+	return redis.Int(scripts.RequeueAll.Do(conn,
+		key, q.Cfg.key("todo"), q.Cfg.key("claims"), q.Cfg.key("unique"),
+		q.metaKey(nil), flag(len(reset) > 0 && reset[0]), flag(q.Cfg.UniqueTasks), q.Cfg.Delimiter, q.Cfg.PriorityLevels))
+}
@@ -0,0 +1,74 @@
+package relyq
+
+import (
+	"testing"
+)
+
+func TestRequeue(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "broken"})
+	push(t, q, ArbitraryTask{"f": "stuck"})
+	push(t, q, ArbitraryTask{"f": "waiting"})
+
+	broken, stuck := ArbitraryTask{}, ArbitraryTask{}
+	if ok, err := q.Process(&broken); !ok || err != nil {
+		t.Error("Process", ok, err)
+	} else if err := q.Fail(broken); err != nil {
+		t.Error("Fail", err)
+	}
+	if ok, err := q.Process(&stuck); !ok || err != nil {
+		t.Error("Process", ok, err)
+	}
+
+	if err := q.Requeue(broken, true); err != nil {
+		t.Error("Requeue", err)
+	}
+	if n, err := q.Attempts(broken.Id()); err != nil || n != 0 {
+		t.Error("Attempts should be reset", n, err)
+	}
+
+	if err := q.Requeue(stuck); err != nil {
+		t.Error("Requeue", err)
+	}
+
+	checkTaskList(t, q, q.Failed)
+	checkTaskList(t, q, q.Doing)
+	checkTaskList(t, q, q.Todo, ArbitraryTask{"f": "stuck"}, ArbitraryTask{"f": "broken"}, ArbitraryTask{"f": "waiting"})
+
+	if err := q.Requeue(stuck); err == nil {
+		t.Error("Requeue of a task in Todo should fail")
+	}
+}
+
+func TestRequeueAll(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	for _, f := range []string{"a", "b", "c"} {
+		push(t, q, ArbitraryTask{"f": f})
+	}
+
+	for i := 0; i < 3; i++ {
+		tp := ArbitraryTask{}
+		if ok, err := q.Process(&tp); !ok || err != nil {
+			t.Error("Process", ok, err)
+		} else if err := q.Fail(tp); err != nil {
+			t.Error("Fail", err)
+		}
+	}
+
+	push(t, q, ArbitraryTask{"f": "d"})
+
+	if n, err := q.RequeueAll(q.Failed); err != nil || n != 3 {
+		t.Error("RequeueAll", n, err)
+	}
+
+	checkTaskList(t, q, q.Failed)
+	checkTaskList(t, q, q.Todo, ArbitraryTask{"f": "c"}, ArbitraryTask{"f": "b"}, ArbitraryTask{"f": "a"}, ArbitraryTask{"f": "d"})
+
+	if _, err := q.RequeueAll(q.Todo); err == nil {
+		t.Error("RequeueAll from Todo should fail")
+	}
+}
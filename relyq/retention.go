@@ -0,0 +1,86 @@
+package relyq
+
+import (
+	"errors"
+	"github.com/Rafflecopter/golang-relyq/scripts"
+	"github.com/Rafflecopter/golang-simpleq/simpleq"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// How many tasks Trim drops at a time, so redis isn't blocked for long
+const trimBatchSize = 1000
+
+// How much of the Done or Failed queue to keep
+type Retention struct {
+	// Keep at most this many tasks. 0 is unlimited.
+	MaxLength int
+	// Drop tasks finished (or failed) longer ago than this. 0 is unlimited.
+	// Tasks whose Meta wasn't kept (e.g. done without KeepDoneTasks) count as old.
+	MaxAge time.Duration
+}
+
+// Whether the policy limits anything
+func (r Retention) IsZero() bool {
+	return r.MaxLength <= 0 && r.MaxAge <= 0
+}
+
+// Trim the oldest tasks off the Done or Failed queue according to a policy,
+// deleting them from storage. Returns how many were trimmed.
+// Tasks are trimmed a batch at a time, so a long queue doesn't block redis.
+func (q *Queue) Trim(subq *simpleq.Queue, policy Retention) (int, error) {
+	var key, field string
+	switch {
+	case subq == nil:
+		return 0, errors.New("Can only trim the Done or Failed queues.")
+	case subq == q.Done:
+		key, field = q.Cfg.key("done"), "finished_at"
+	case subq == q.Failed:
+		key, field = q.Cfg.key("failed"), "failed_at"
+	default:
+		return 0, errors.New("Can only trim the Done or Failed queues.")
+	}
+
+	var cutoff int64
+	if policy.MaxAge > 0 {
+		cutoff = toMillis(time.Now().Add(-policy.MaxAge))
+	}
+
+	trimmed := 0
+	for {
+		conn := q.pool.Get()
+		ids, err := redis.ByteSlices(scripts.Trim.Do(conn, key,
+			q.metaKey(nil), policy.MaxLength, cutoff, field, trimBatchSize))
+		conn.Close()
+
+		if err != nil {
+			return trimmed, err
+		}
+
+		for _, id := range ids {
+			if err := q.Storage.Del(id); err != nil {
+				return trimmed, err
+			}
+			trimmed++
+		}
+
+		if len(ids) < trimBatchSize {
+			return trimmed, nil
+		}
+	}
+}
+
+// Trim the Done and Failed queues by their retention policies
+func (q *Queue) trimAll() error {
+	if q.Done != nil && !q.Cfg.DoneRetention.IsZero() {
+		if _, err := q.Trim(q.Done, q.Cfg.DoneRetention); err != nil {
+			return err
+		}
+	}
+
+	if !q.Cfg.FailedRetention.IsZero() {
+		_, err := q.Trim(q.Failed, q.Cfg.FailedRetention)
+		return err
+	}
+	return nil
+}
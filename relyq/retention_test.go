@@ -0,0 +1,101 @@
+package relyq
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTrim(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.UseDoneQueue = true
+	cfg.KeepDoneTasks = true
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	for _, f := range []string{"a", "b", "c", "d"} {
+		push(t, q, ArbitraryTask{"f": f})
+		tp := ArbitraryTask{}
+		if ok, err := q.Process(&tp); !ok || err != nil {
+			t.Error("Process", ok, err)
+		} else if err := q.Finish(tp); err != nil {
+			t.Error("Finish", err)
+		}
+	}
+
+	oldest, err := q.Done.List()
+	if err != nil || len(oldest) != 4 {
+		t.Fatal("Done.List", oldest, err)
+	}
+
+	if n, err := q.Trim(q.Done, Retention{MaxLength: 3}); n != 1 || err != nil {
+		t.Error("Trim", n, err)
+	}
+	checkTaskList(t, q, q.Done, ArbitraryTask{"f": "d"}, ArbitraryTask{"f": "c"}, ArbitraryTask{"f": "b"})
+
+	// The trimmed task is gone from storage
+	if m, err := q.Meta(oldest[3]); m != nil || err != nil {
+		t.Error("Meta should be deleted", m, err)
+	}
+	if err := q.Storage.Get(oldest[3], &ArbitraryTask{}); err == nil {
+		t.Error("Stored task should be deleted")
+	}
+
+	if n, err := q.Trim(q.Done, Retention{MaxAge: time.Hour}); n != 0 || err != nil {
+		t.Error("Trim recent", n, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if n, err := q.Trim(q.Done, Retention{MaxAge: 10 * time.Millisecond}); n != 3 || err != nil {
+		t.Error("Trim by age", n, err)
+	}
+	checkTaskList(t, q, q.Done)
+
+	if _, err := q.Trim(q.Todo, Retention{MaxLength: 1}); err == nil {
+		t.Error("Trim should only accept Done and Failed")
+	}
+}
+
+func TestFailedRetention(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.FailedRetention = Retention{MaxLength: 2}
+	cfg.RetentionPollInterval = 10 * time.Millisecond
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	for _, f := range []string{"a", "b", "c"} {
+		push(t, q, ArbitraryTask{"f": f})
+		tp := ArbitraryTask{}
+		if ok, err := q.Process(&tp); !ok || err != nil {
+			t.Error("Process", ok, err)
+		} else if err := q.Fail(tp); err != nil {
+			t.Error("Fail", err)
+		}
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	checkTaskList(t, q, q.Failed, ArbitraryTask{"f": "c"}, ArbitraryTask{"f": "b"})
+}
+
+func TestTrimBatches(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.UseDoneQueue = true
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	n := 2*trimBatchSize + 500
+	args := []interface{}{q.Cfg.key("done")}
+	for i := 0; i < n; i++ {
+		args = append(args, fmt.Sprintf("task%d", i))
+	}
+	if _, err := q.do("LPUSH", args...); err != nil {
+		t.Fatal("LPUSH", err)
+	}
+
+	if trimmed, err := q.Trim(q.Done, Retention{MaxLength: 10}); err != nil || trimmed != n-10 {
+		t.Error("Trim", trimmed, err)
+	}
+	if ids, err := q.Done.List(); err != nil || len(ids) != 10 {
+		t.Error("Done should keep 10 tasks", len(ids), err)
+	}
+}
@@ -0,0 +1,53 @@
+package relyq
+
+import (
+	"context"
+	"fmt"
+	"github.com/Rafflecopter/golang-relyq/scripts"
+	"github.com/garyburd/redigo/redis"
+	"math/rand"
+	"time"
+)
+
+// Reason set on tasks moved to Dead because they ran out of attempts
+const ReasonExhausted = "attempts exhausted"
+
+// Count a failed attempt at a task in Doing and either schedule a retry or move it to Failed
+// (or Dead, if it is out of retries and UseDeadQueue is set).
+// The cause, if not nil, is recorded in the task's meta.
+// If a claim token is given, it must still be current.
+// Returns whether the task will be retried.
+func (q *Queue) failRetry(ctx context.Context, task Ider, cause error, token string) (bool, error) {
+	id := task.Id()
+
+	var msg, typ string
+	if cause != nil {
+		msg, typ = cause.Error(), fmt.Sprintf("%T", cause)
+	}
+
+	target, reason, state := q.Cfg.key("failed"), "", StateFailed
+	if q.Retrying != nil && q.Dead != nil {
+		target, reason, state = q.Cfg.key("dead"), ReasonExhausted, StateDead
+	}
+
+	reply, err := q.transition(ctx, scripts.FailRetry, id, task,
+		[]interface{}{q.Cfg.key("doing"), target, q.Cfg.key("retrying"), q.metaKey(id), q.Cfg.key("claims"), q.Cfg.key("unique")},
+		id, q.Cfg.MaxAttempts, toMillis(time.Now()),
+		int64(q.Cfg.RetryBackoff/time.Millisecond), int64(q.Cfg.MaxRetryBackoff/time.Millisecond),
+		rand.Float64(), reason, state, msg, typ, token)
+
+	if n, ok := reply.(int64); ok && n == -1 {
+		return false, ErrLeaseLost
+	} else if err == nil {
+		q.forgetLease(id, token)
+	}
+
+	res, err := redis.Int64s(reply, err)
+	if err == redis.ErrNil {
+		return false, fmt.Errorf("Task %s not found in Doing queue.", id)
+	} else if err != nil {
+		return false, err
+	}
+
+	return res[1] > 0, nil
+}
@@ -0,0 +1,78 @@
+package relyq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFailRetry(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxAttempts = 3
+	cfg.RetryBackoff = 20 * time.Millisecond
+	cfg.DeferPollInterval = 5 * time.Millisecond
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "flaky"})
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		tp := ArbitraryTask{}
+		if err := q.BProcess(1, &tp); err != nil {
+			t.Error("BProcess", attempt, err)
+			return
+		}
+		checkTaskEqual(t, tp, ArbitraryTask{"f": "flaky"})
+
+		if err := q.Fail(tp); err != nil {
+			t.Error("Fail", attempt, err)
+		}
+
+		if n, err := q.Attempts(tp.Id()); err != nil || n != attempt {
+			t.Error("Attempts", n, err)
+		}
+
+		if attempt < 3 {
+			checkTaskList(t, q, q.Failed)
+			if list, err := q.Retrying.List(); err != nil || len(list) != 1 {
+				t.Error("Retrying.List", list, err)
+			}
+		}
+	}
+
+	checkTaskList(t, q, q.Todo)
+	checkTaskList(t, q, q.Doing)
+	checkTaskList(t, q, q.Failed, ArbitraryTask{"f": "flaky"})
+}
+
+func TestFailRetryBackoff(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxAttempts = 5
+	cfg.RetryBackoff = time.Second
+	cfg.MaxRetryBackoff = 3 * time.Second
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "slow"})
+
+	tp := ArbitraryTask{}
+	for _, bounds := range [][2]time.Duration{{500, 1000}, {1000, 2000}, {1500, 3000}} {
+		if ok, err := q.Process(&tp); !ok || err != nil {
+			t.Error("Process", ok, err)
+			return
+		}
+		start := time.Now()
+		if err := q.Fail(tp); err != nil {
+			t.Error("Fail", err)
+		}
+
+		if when, ok, err := q.Retrying.When(tp.Id()); err != nil || !ok {
+			t.Error("Retrying.When", ok, err)
+		} else if d := when.Sub(start); d < bounds[0]*time.Millisecond-10*time.Millisecond || d > bounds[1]*time.Millisecond+10*time.Millisecond {
+			t.Error("Backoff out of bounds", d, bounds)
+		}
+
+		// Skip the wait
+		q.Retrying.Cancel(tp.Id())
+		push(t, q, tp)
+	}
+}
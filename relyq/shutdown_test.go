@@ -0,0 +1,171 @@
+package relyq
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestListenerShutdown(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "first"})
+	push(t, q, ArbitraryTask{"f": "second"})
+
+	l := q.Listen(ArbitraryTask{})
+
+	var task Ider
+	select {
+	case task = <-l.Tasks:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for task")
+	}
+
+	// Let the listener claim the second task, then shut down with the first in hand
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	done := make(chan error)
+	go func() { done <- l.Shutdown(ctx) }()
+
+	select {
+	case err := <-done:
+		t.Fatal("Shutdown shouldn't return with a task in hand", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	l.Finish <- task
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("Shutdown", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Shutdown didn't return")
+	}
+
+	if _, ok := <-l.Tasks; ok {
+		t.Error("Tasks should be closed")
+	}
+	for range l.Errors {
+	}
+
+	checkTaskList(t, q, q.Doing)
+	checkTaskList(t, q, q.Todo, ArbitraryTask{"f": "second"})
+}
+
+func TestListenerShutdownTimeout(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "held"})
+
+	l := q.Listen(ArbitraryTask{})
+	select {
+	case <-l.Tasks:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for task")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	if err := l.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("Expected context.DeadlineExceeded", err)
+	}
+	checkTaskList(t, q, q.Doing, ArbitraryTask{"f": "held"})
+}
+
+func TestListenerShutdownPriority(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.PriorityLevels = 2
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	for i := 0; i < 3; i++ {
+		if err := q.PushPriority(ArbitraryTask{"f": "task"}, 1); err != nil {
+			t.Fatal("PushPriority", err)
+		}
+	}
+
+	l := q.Listen(ArbitraryTask{})
+	go func() {
+		for range l.Errors {
+		}
+	}()
+
+	var task Ider
+	select {
+	case task = <-l.Tasks:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for task")
+	}
+
+	// Let the listener claim the second task and pop the third
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	done := make(chan error)
+	go func() { done <- l.Shutdown(ctx) }()
+	l.Finish <- task
+
+	if err := <-done; err != nil {
+		t.Error("Shutdown", err)
+	}
+
+	checkTaskList(t, q, q.Doing)
+	todo := 0
+	for _, sq := range q.Todos {
+		els, err := sq.List()
+		if err != nil {
+			t.Error("List", err)
+		}
+		todo += len(els)
+	}
+	if todo != 2 {
+		t.Error("Expected 2 tasks back in Todo, got", todo)
+	}
+}
+
+func TestListenerShutdownFinishedOnQueue(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.PriorityPollInterval = time.Hour
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "direct"})
+
+	l := q.ListenWithOptions(ArbitraryTask{}, ListenerOptions{ShutdownPollInterval: 20 * time.Millisecond})
+	var task Ider
+	select {
+	case task = <-l.Tasks:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for task")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	done := make(chan error)
+	go func() { done <- l.Shutdown(ctx) }()
+
+	// Finished on the queue, not through the listener
+	if err := q.Finish(task); err != nil {
+		t.Error("Finish", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("Shutdown", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Shutdown didn't notice the task was finished")
+	}
+	checkTaskList(t, q, q.Doing)
+}
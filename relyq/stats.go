@@ -0,0 +1,72 @@
+package relyq
+
+import (
+	"github.com/Rafflecopter/golang-relyq/scripts"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// A snapshot of the queue's subqueues, taken atomically
+type Stats struct {
+	// Todo is every priority level together, Todos each level (lowest first)
+	Todo   SubqueueStats
+	Todos  []SubqueueStats
+	Doing  SubqueueStats
+	Failed SubqueueStats
+	// Empty unless the subqueue is in use
+	Done     SubqueueStats
+	Dead     SubqueueStats
+	Deferred SubqueueStats
+	Retrying SubqueueStats
+}
+
+// The length of one subqueue and the age of its oldest task
+type SubqueueStats struct {
+	Length int64
+	// How long ago the task at the front of the subqueue was pushed.
+	// That is the next task to be processed, or for Deferred and Retrying the next one due.
+	// Zero if the subqueue is empty.
+	OldestAge time.Duration
+}
+
+// Get the length of each subqueue and the age of its oldest task, in one call
+func (q *Queue) Stats() (*Stats, error) {
+	keys := make([]interface{}, 0, len(q.Todos)+6)
+	for level := range q.Todos {
+		keys = append(keys, q.todoKey(level))
+	}
+	for _, name := range []string{"doing", "failed", "done", "dead", "deferred", "retrying"} {
+		keys = append(keys, q.Cfg.key(name))
+	}
+
+	reply, err := redis.Values(q.eval(scripts.Stats, keys, q.metaKey(nil)))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	subqs := make([]SubqueueStats, len(reply))
+	for i, r := range reply {
+		vals, err := redis.Int64s(r, nil)
+		if err != nil {
+			return nil, err
+		}
+		subqs[i].Length = vals[0]
+		if vals[1] > 0 {
+			subqs[i].OldestAge = now.Sub(fromMillis(vals[1]))
+		}
+	}
+
+	levels := len(q.Todos)
+	s := &Stats{Todos: subqs[:levels]}
+	for _, level := range s.Todos {
+		s.Todo.Length += level.Length
+		if level.OldestAge > s.Todo.OldestAge {
+			s.Todo.OldestAge = level.OldestAge
+		}
+	}
+
+	rest := subqs[levels:]
+	s.Doing, s.Failed, s.Done, s.Dead, s.Deferred, s.Retrying = rest[0], rest[1], rest[2], rest[3], rest[4], rest[5]
+	return s, nil
+}
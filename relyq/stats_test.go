@@ -0,0 +1,47 @@
+package relyq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AllowDefer = true
+	cfg.PriorityLevels = 2
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "old"})
+	time.Sleep(30 * time.Millisecond)
+	push(t, q, ArbitraryTask{"f": "new"})
+	if err := q.PushPriority(ArbitraryTask{"f": "urgent"}, 1); err != nil {
+		t.Error("PushPriority", err)
+	}
+	if err := q.PushAfter(ArbitraryTask{"f": "later"}, time.Hour); err != nil {
+		t.Error("PushAfter", err)
+	}
+
+	tp := ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	}
+
+	s, err := q.Stats()
+	if err != nil {
+		t.Fatal("Stats", err)
+	}
+
+	if s.Todo.Length != 2 || len(s.Todos) != 2 || s.Todos[0].Length != 2 || s.Todos[1].Length != 0 {
+		t.Error("Bad Todo stats", s.Todo, s.Todos)
+	}
+	if s.Todo.OldestAge < 30*time.Millisecond || s.Todo.OldestAge > time.Second {
+		t.Error("Bad Todo age", s.Todo.OldestAge)
+	}
+	if s.Todos[1].OldestAge != 0 {
+		t.Error("Empty level should have no age", s.Todos[1].OldestAge)
+	}
+	if s.Doing.Length != 1 || s.Deferred.Length != 1 || s.Failed.Length != 0 || s.Done.Length != 0 {
+		t.Error("Bad stats", s)
+	}
+}
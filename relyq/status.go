@@ -0,0 +1,53 @@
+package relyq
+
+import (
+	"github.com/garyburd/redigo/redis"
+)
+
+// Where a task is
+type TaskStatus struct {
+	// One of the State constants, or empty if the task isn't known
+	// (e.g. it was finished without KeepDoneTasks, or removed)
+	State string
+	// Position in Deferred or Retrying, 0 being the next due. -1 in other states.
+	Position int
+	// Everything else relyq knows about the task. Nil if the task isn't known.
+	Meta *Meta
+}
+
+// Look up a task by id. If task is not nil and the task is known, the stored task is decoded into it.
+func (q *Queue) Status(id []byte, task interface{}) (*TaskStatus, error) {
+	meta, err := q.Meta(id)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &TaskStatus{Position: -1, Meta: meta}
+	if meta == nil {
+		return s, nil
+	}
+	s.State = meta.State
+
+	var zset *Deferred
+	switch s.State {
+	case StateDeferred:
+		zset = q.Deferred
+	case StateRetrying:
+		zset = q.Retrying
+	}
+
+	if zset != nil {
+		if s.Position, err = redis.Int(zset.do("ZRANK", zset.key, id)); err == redis.ErrNil {
+			s.Position = -1
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if task != nil {
+		if err := q.Storage.Get(id, task); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,57 @@
+package relyq
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatus(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AllowDefer = true
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"id": "running"})
+	push(t, q, ArbitraryTask{"id": "waiting"})
+	if err := q.PushAfter(ArbitraryTask{"id": "soon"}, time.Minute); err != nil {
+		t.Error("PushAfter", err)
+	}
+	if err := q.PushAfter(ArbitraryTask{"id": "later"}, time.Hour); err != nil {
+		t.Error("PushAfter", err)
+	}
+
+	tp := ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	}
+
+	checkStatus(t, q, "running", StateDoing, -1)
+	checkStatus(t, q, "waiting", StateTodo, -1)
+	checkStatus(t, q, "soon", StateDeferred, 0)
+	checkStatus(t, q, "later", StateDeferred, 1)
+
+	if err := q.Fail(tp); err != nil {
+		t.Error("Fail", err)
+	}
+	checkStatus(t, q, "running", StateFailed, -1)
+
+	body := ArbitraryTask{}
+	if s, err := q.Status([]byte("waiting"), &body); err != nil || s.Meta == nil {
+		t.Error("Status", s, err)
+	} else {
+		checkTaskEqual(t, body, ArbitraryTask{"id": "waiting"})
+	}
+
+	if s, err := q.Status([]byte("unknown"), &body); err != nil || s.State != "" || s.Meta != nil {
+		t.Error("Unknown task should have no status", s, err)
+	}
+}
+
+func checkStatus(t *testing.T, q *Queue, id, state string, position int) {
+	s, err := q.Status([]byte(id), nil)
+	if err != nil {
+		t.Error("Status", id, err)
+	} else if s.State != state || s.Position != position {
+		t.Error("Expected", id, state, position, "got", s.State, s.Position)
+	}
+}
@@ -0,0 +1,76 @@
+package relyq
+
+import (
+	"github.com/Rafflecopter/golang-relyq/scripts"
+	"github.com/garyburd/redigo/redis"
+	"github.com/satori/go.uuid"
+	"time"
+)
+
+// Reason set on tasks moved to Failed because they timed out
+const ReasonTimeout = "timeout"
+
+// Record that tasks were just moved into Doing, and by which worker, so they
+// can be reclaimed after ProcessTimeout. They share a new claim token.
+// Tasks past their deadline are expired instead and returned.
+func (q *Queue) claim(ids ...[]byte) (expired [][]byte, err error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	var deadline int64
+	if q.Cfg.ProcessTimeout > 0 {
+		deadline = toMillis(now.Add(q.Cfg.ProcessTimeout))
+	}
+
+	target, state := q.Cfg.key("failed"), StateFailed
+	if q.Dead != nil {
+		target, state = q.Cfg.key("dead"), StateDead
+	}
+
+	token := uuid.NewV4().String()
+
+	args := make([]interface{}, 0, len(ids)+11)
+	args = append(args, q.Cfg.key("claims"), q.Cfg.key("doing"), target, q.Cfg.key("unique"),
+		toMillis(now), deadline, q.metaKey(nil), ReasonExpired, state, q.Cfg.WorkerId, token)
+	for _, id := range ids {
+		args = append(args, id)
+	}
+
+	conn := q.pool.Get()
+	defer conn.Close()
+
+	if expired, err = redis.ByteSlices(scripts.Claim.Do(conn, args...)); err != nil {
+		return nil, err
+	}
+	q.recordLease(without(ids, expired), token)
+	return expired, nil
+}
+
+// Forget the claim on a task that has left Doing
+func (q *Queue) unclaim(id []byte) error {
+	if q.Cfg.ProcessTimeout <= 0 {
+		return nil
+	}
+	_, err := q.do("ZREM", q.Cfg.key("claims"), id)
+	return err
+}
+
+// Move tasks whose claims have expired out of Doing.
+// They go back to Todo, or to Failed with ReasonTimeout if FailOnTimeout is set.
+// Returns the ids of the reclaimed tasks.
+func (q *Queue) reclaim(now time.Time) ([][]byte, error) {
+	target, reason, state := q.Cfg.key("todo"), "", StateTodo
+	if q.Cfg.FailOnTimeout {
+		target, reason, state = q.Cfg.key("failed"), ReasonTimeout, StateFailed
+	}
+
+	conn := q.pool.Get()
+	defer conn.Close()
+
+	return redis.ByteSlices(scripts.Reclaim.Do(conn,
+		q.Cfg.key("claims"), q.Cfg.key("doing"), target, q.Cfg.key("unique"),
+		toMillis(now), toMillis(now.Add(q.Cfg.ProcessTimeout)), q.metaKey(nil), reason, state,
+		q.Cfg.Delimiter, q.Cfg.PriorityLevels))
+}
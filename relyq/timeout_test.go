@@ -0,0 +1,89 @@
+package relyq
+
+import (
+	"testing"
+	"time"
+)
+
+func timeoutConfig() *Config {
+	cfg := defaultConfig()
+	cfg.ProcessTimeout = 30 * time.Millisecond
+	cfg.TimeoutPollInterval = 10 * time.Millisecond
+	return cfg
+}
+
+func TestProcessTimeout(t *testing.T) {
+	q := begin(nil, timeoutConfig())
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "stuck"})
+	push(t, q, ArbitraryTask{"f": "next"})
+
+	tp := ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	}
+
+	checkTaskList(t, q, q.Doing, ArbitraryTask{"f": "stuck"})
+	time.Sleep(100 * time.Millisecond)
+
+	checkTaskList(t, q, q.Doing)
+	checkTaskList(t, q, q.Todo, ArbitraryTask{"f": "stuck"}, ArbitraryTask{"f": "next"})
+
+	if reason, err := q.Reason(tp.Id()); err != nil || reason != "" {
+		t.Error("Reason should be empty when requeued", reason, err)
+	}
+}
+
+func TestProcessTimeoutFail(t *testing.T) {
+	cfg := timeoutConfig()
+	cfg.FailOnTimeout = true
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "stuck"})
+
+	tp := ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	checkTaskList(t, q, q.Doing)
+	checkTaskList(t, q, q.Failed, ArbitraryTask{"f": "stuck"})
+
+	if reason, err := q.Reason(tp.Id()); err != nil || reason != ReasonTimeout {
+		t.Error("Reason", reason, err)
+	}
+
+	// A timed out task can still be finished
+	if err := q.Finish(tp); err != nil {
+		t.Error("Finish", err)
+	}
+	checkTaskList(t, q, q.Failed)
+
+	if reason, err := q.Reason(tp.Id()); err != nil || reason != "" {
+		t.Error("Reason should be deleted with the task", reason, err)
+	}
+}
+
+func TestProcessWithinTimeout(t *testing.T) {
+	q := begin(nil, timeoutConfig())
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "quick"})
+
+	tp := ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	}
+	if err := q.Finish(tp); err != nil {
+		t.Error("Finish", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	checkTaskList(t, q, q.Todo)
+	checkTaskList(t, q, q.Doing)
+}
@@ -0,0 +1,76 @@
+package relyq
+
+import (
+	"context"
+	"errors"
+	"github.com/Rafflecopter/golang-relyq/scripts"
+	"github.com/Rafflecopter/golang-simpleq/simpleq"
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+// Returned when pushing a task whose id is already pending with UniqueTasks set
+var ErrDuplicate = errors.New("relyq: task is already pending")
+
+// Push a task onto a todo list, or a zset if score is given, unless its id
+// is already pending (in Todo, Doing, Deferred or Retrying).
+// The task is only stored if it was pushed. Its meta records when it was pushed.
+func (q *Queue) pushUnique(ctx context.Context, task interface{}, id []byte, target string, score interface{}, level int, deadline time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	keys := []interface{}{q.Cfg.key("unique"), target, q.metaKey(id)}
+	state := StateTodo
+	if score != "" {
+		state = StateDeferred
+	}
+
+	args := []interface{}{id, score, state, toMillis(time.Now()), "", ""}
+	if !deadline.IsZero() {
+		args[4] = toMillis(deadline)
+	}
+	if level > 0 {
+		args[5] = level
+	}
+
+	if q.atomic != nil {
+		val, err := q.atomic.Marshal(task)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, q.atomic.Key(id))
+		args = append(args, val)
+	}
+
+	n, err := redis.Int(q.evalContext(ctx, scripts.PushUnique, keys, args...))
+	if err != nil {
+		return err
+	} else if n == 0 {
+		return ErrDuplicate
+	}
+
+	if q.atomic == nil {
+		return q.setTask(ctx, task, id)
+	}
+	return nil
+}
+
+// Forget that a task is pending
+func (q *Queue) release(id []byte) error {
+	_, err := q.do("SREM", q.Cfg.key("unique"), id)
+	return err
+}
+
+// Whether a simpleq holds pending tasks
+func (q *Queue) isPending(subq *simpleq.Queue) bool {
+	if subq == q.Doing {
+		return true
+	}
+	for _, todo := range q.Todos {
+		if subq == todo {
+			return true
+		}
+	}
+	return false
+}
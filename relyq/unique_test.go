@@ -0,0 +1,153 @@
+package relyq
+
+import (
+	"testing"
+	"time"
+)
+
+func uniqueConfig() *Config {
+	cfg := defaultConfig()
+	cfg.UniqueTasks = true
+	cfg.AllowDefer = true
+	return cfg
+}
+
+func TestUniquePush(t *testing.T) {
+	q := begin(nil, uniqueConfig())
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "once", "id": "abc"})
+
+	if err := q.Push(ArbitraryTask{"f": "twice", "id": "abc"}); err != ErrDuplicate {
+		t.Error("Expected ErrDuplicate", err)
+	}
+	checkTaskList(t, q, q.Todo, ArbitraryTask{"f": "once"})
+
+	tp := ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	}
+
+	if err := q.Push(ArbitraryTask{"f": "while doing", "id": "abc"}); err != ErrDuplicate {
+		t.Error("Expected ErrDuplicate while in Doing", err)
+	}
+	if err := q.PushAfter(ArbitraryTask{"f": "deferred", "id": "abc"}, time.Hour); err != ErrDuplicate {
+		t.Error("Expected ErrDuplicate for deferred push", err)
+	}
+
+	if err := q.Finish(tp); err != nil {
+		t.Error("Finish", err)
+	}
+
+	push(t, q, ArbitraryTask{"f": "again", "id": "abc"})
+	checkTaskList(t, q, q.Todo, ArbitraryTask{"f": "again"})
+}
+
+func TestUniqueDeferred(t *testing.T) {
+	q := begin(nil, uniqueConfig())
+	defer end(t, q)
+
+	task := ArbitraryTask{"f": "later", "id": "def"}
+	if err := q.PushAfter(task, time.Hour); err != nil {
+		t.Error("PushAfter", err)
+	}
+	if err := q.Push(ArbitraryTask{"f": "now", "id": "def"}); err != ErrDuplicate {
+		t.Error("Expected ErrDuplicate", err)
+	}
+
+	if err := q.RemoveDeferred(task); err != nil {
+		t.Error("RemoveDeferred", err)
+	}
+	push(t, q, ArbitraryTask{"f": "now", "id": "def"})
+}
+
+func TestUniqueFailRemove(t *testing.T) {
+	q := begin(nil, uniqueConfig())
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "a", "id": "1"})
+	push(t, q, ArbitraryTask{"f": "b", "id": "2"})
+
+	tp := ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	} else if err := q.Fail(tp); err != nil {
+		t.Error("Fail", err)
+	}
+
+	if err := q.Remove(q.Todo, ArbitraryTask{"id": "2"}); err != nil {
+		t.Error("Remove", err)
+	}
+
+	if err := q.PushBatch([]Ider{ArbitraryTask{"f": "a", "id": "1"}, ArbitraryTask{"f": "b", "id": "2"}}); err != nil {
+		t.Error("PushBatch", err)
+	}
+	if err := q.PushBatch([]Ider{ArbitraryTask{"f": "c", "id": "3"}, ArbitraryTask{"f": "b", "id": "2"}}); err != ErrDuplicate {
+		t.Error("Expected ErrDuplicate from PushBatch", err)
+	}
+
+	checkTaskList(t, q, q.Todo, ArbitraryTask{"f": "c"}, ArbitraryTask{"f": "b"}, ArbitraryTask{"f": "a"})
+}
+
+func TestUniqueNonAtomic(t *testing.T) {
+	cfg := uniqueConfig()
+	q := begin(plainStorage{basicStorage(cfg.Prefix)}, cfg)
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "original", "id": "xyz"})
+	if err := q.Push(ArbitraryTask{"f": "overwrite", "id": "xyz"}); err != ErrDuplicate {
+		t.Error("Expected ErrDuplicate", err)
+	}
+
+	// The duplicate didn't overwrite storage
+	checkTaskList(t, q, q.Todo, ArbitraryTask{"f": "original"})
+}
+
+func TestUniqueDeferredCancel(t *testing.T) {
+	q := begin(nil, uniqueConfig())
+	defer end(t, q)
+
+	task := ArbitraryTask{"f": "later", "id": "abc"}
+	if err := q.PushAfter(task, time.Hour); err != nil {
+		t.Error("PushAfter", err)
+	}
+	if ok, err := q.Deferred.Cancel(task.Id()); !ok || err != nil {
+		t.Error("Deferred.Cancel", ok, err)
+	}
+	push(t, q, task)
+
+	if err := q.PushAfter(ArbitraryTask{"f": "removed", "id": "def"}, time.Hour); err != nil {
+		t.Error("PushAfter", err)
+	}
+	if err := q.RemoveDeferred(ArbitraryTask{"id": "def"}); err != nil {
+		t.Error("RemoveDeferred", err)
+	}
+	push(t, q, ArbitraryTask{"f": "again", "id": "def"})
+}
+
+func TestUniqueKill(t *testing.T) {
+	cfg := uniqueConfig()
+	cfg.UseDeadQueue = true
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"f": "poison", "id": "abc"})
+	tp := ArbitraryTask{}
+	if ok, err := q.Process(&tp); !ok || err != nil {
+		t.Error("Process", ok, err)
+	}
+	if err := q.Kill(tp, "malformed"); err != nil {
+		t.Error("Kill", err)
+	}
+
+	// Dead tasks aren't pending, until resurrected
+	if n, err := q.do("SISMEMBER", q.Cfg.key("unique"), "abc"); err != nil || n.(int64) != 0 {
+		t.Error("Killed task should be released", n, err)
+	}
+	if err := q.Resurrect(tp.Id()); err != nil {
+		t.Error("Resurrect", err)
+	}
+	if err := q.Push(ArbitraryTask{"id": "abc"}); err != ErrDuplicate {
+		t.Error("Expected ErrDuplicate after Resurrect", err)
+	}
+}
@@ -0,0 +1,133 @@
+package relyq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Handles a task. Returning nil finishes it, an error fails it.
+// ctx is cancelled if the task's lease is lost (see Touch).
+type Handler func(ctx context.Context, task Ider) error
+
+// A pool of handlers run by Queue.Serve
+type Worker struct {
+	Handler Handler
+	// Makes an empty task to decode each one into, e.g. func() Ider { return new(Task) }
+	Factory func() Ider
+	// How many tasks to handle at once
+	// Defaults to 1
+	Concurrency int
+}
+
+// The error a task is failed with when its handler panics
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("relyq: handler panicked: %v", e.Value)
+}
+
+// Process tasks with a worker's handlers until ctx is done, then wait for
+// the tasks in hand to be handled. Each task is finished if its handler returns nil,
+// and failed with its error (or a *PanicError) otherwise. With a ProcessTimeout,
+// tasks are kept alive with a Heartbeat while they are handled.
+// Errors from the queue are sent on q.Errors.
+// Like BProcessContext, it can take up to a second to notice ctx is done.
+// A task claimed just as ctx is done is still handled, so none is left in Doing.
+func (q *Queue) Serve(ctx context.Context, w Worker) error {
+	if w.Handler == nil || w.Factory == nil {
+		return errors.New("relyq: Worker needs a Handler and a Factory")
+	}
+
+	n := w.Concurrency
+	if n < 1 {
+		n = 1
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			q.work(ctx, w)
+		}()
+	}
+
+	wg.Wait()
+	return nil
+}
+
+// Process and handle tasks one at a time until ctx is done
+func (q *Queue) work(ctx context.Context, w Worker) {
+	for ctx.Err() == nil {
+		task := w.Factory()
+		if err := q.BProcessContext(ctx, task); err != nil && err == ctx.Err() {
+			return
+		} else if err != nil {
+			reportError(q.Errors, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		q.handle(task, q.leaseOf(task.Id()), w.Handler)
+	}
+}
+
+// Handle a task in Doing under a claim token, then finish or fail it
+func (q *Queue) handle(task Ider, token string, handler Handler) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var lost int32
+	if q.Cfg.ProcessTimeout > 0 {
+		hb := q.heartbeat(task.Id(), token, q.heartbeatInterval())
+		defer hb.Stop()
+
+		go func() {
+			select {
+			case <-hb.Lost:
+				atomic.StoreInt32(&lost, 1)
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	err := callHandler(ctx, handler, task)
+
+	if atomic.LoadInt32(&lost) == 1 {
+		q.forgetLease(task.Id(), token)
+		reportError(q.Errors, ErrLeaseLost)
+		return
+	}
+
+	if err == nil {
+		err = q.finish(context.Background(), task, token)
+	} else {
+		_, err = q.failRetry(context.Background(), task, err, token)
+	}
+
+	if err != nil {
+		reportError(q.Errors, err)
+	}
+}
+
+// Call a handler, turning a panic into a *PanicError
+func callHandler(ctx context.Context, handler Handler, task Ider) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return handler(ctx, task)
+}
@@ -0,0 +1,156 @@
+package relyq
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServe(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.UseDoneQueue = true
+	cfg.KeepDoneTasks = true
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"id": "ok"})
+	push(t, q, ArbitraryTask{"id": "bad"})
+	push(t, q, ArbitraryTask{"id": "boom"})
+
+	var handled int32
+	handler := func(ctx context.Context, task Ider) error {
+		defer atomic.AddInt32(&handled, 1)
+		switch string(task.Id()) {
+		case "bad":
+			return errors.New("bad task")
+		case "boom":
+			panic("boom")
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- q.Serve(ctx, Worker{
+			Handler:     handler,
+			Factory:     func() Ider { return &ArbitraryTask{} },
+			Concurrency: 2,
+		})
+	}()
+
+	for i := 0; i < 100 && atomic.LoadInt32(&handled) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Error("Serve", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve didn't stop")
+	}
+
+	checkTaskList(t, q, q.Done, ArbitraryTask{"id": "ok"})
+	checkTaskList(t, q, q.Doing)
+
+	if m, err := q.Meta([]byte("bad")); err != nil || m == nil || m.State != StateFailed || m.LastError != "bad task" {
+		t.Error("Bad meta", m, err)
+	}
+	if m, err := q.Meta([]byte("boom")); err != nil || m == nil || m.State != StateFailed || m.ErrorType != "*relyq.PanicError" {
+		t.Error("Panic not recorded", m, err)
+	}
+}
+
+func TestServeNeedsHandler(t *testing.T) {
+	q := begin(nil, defaultConfig())
+	defer end(t, q)
+
+	if err := q.Serve(context.Background(), Worker{}); err == nil {
+		t.Error("Serve should need a handler and factory")
+	}
+}
+
+func TestServeLeaseLost(t *testing.T) {
+	q := begin(nil, timeoutConfig())
+	defer end(t, q)
+
+	push(t, q, ArbitraryTask{"id": "slow"})
+
+	cancelled := make(chan bool, 1)
+	handler := func(ctx context.Context, task Ider) error {
+		// Lose the lease, as if the task timed out
+		q.reclaim(time.Now().Add(time.Hour))
+		select {
+		case <-ctx.Done():
+			cancelled <- true
+		case <-time.After(time.Second):
+			cancelled <- false
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Serve(ctx, Worker{Handler: handler, Factory: func() Ider { return &ArbitraryTask{} }})
+
+	select {
+	case ok := <-cancelled:
+		if !ok {
+			t.Error("Handler context should be cancelled when the lease is lost")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Handler never ran")
+	}
+
+	select {
+	case err := <-q.Errors:
+		if err != ErrLeaseLost {
+			t.Error("Expected ErrLeaseLost", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Error("Lost lease not reported")
+	}
+}
+
+func TestServeStopsCleanly(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.UseDoneQueue = true
+	cfg.KeepDoneTasks = true
+	q := begin(nil, cfg)
+	defer end(t, q)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- q.Serve(ctx, Worker{
+			Handler: func(ctx context.Context, task Ider) error { return nil },
+			Factory: func() Ider { return &ArbitraryTask{} },
+		})
+	}()
+
+	// Cancel while the blocking pop is handing over a task
+	time.Sleep(50 * time.Millisecond)
+	push(t, q, ArbitraryTask{"f": "raced"})
+	cancel()
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Error("Serve", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve didn't stop")
+	}
+
+	// It was either handled or never popped
+	checkTaskList(t, q, q.Doing)
+	if ids, err := q.Todo.List(); err != nil || len(ids) == 0 {
+		checkTaskList(t, q, q.Done, ArbitraryTask{"f": "raced"})
+	}
+}
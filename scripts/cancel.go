@@ -0,0 +1,37 @@
+package scripts
+
+import "github.com/garyburd/redigo/redis"
+
+// Cancel a pending task by removing it from the first of the todo simpleqs or zsets it is in
+// If it was found, it is removed from the unique set, and its meta hash is deleted if ARGV[2] is "1",
+// otherwise its state is set to cancelled
+// If ARGV[3] is "1", the last key is the task's storage key, deleted along with its meta hash
+// Returns 0 if the task was not pending
+var Cancel = redis.NewScript(
+	-1, // KEYS:[meta_hash, unique_set, (todo_simpleq|deferred_zset)..., (storage)], ARGV:[id, delete, has_storage]
+	`local last = table.getn(KEYS)
+  if ARGV[3] == "1" then
+    last = last - 1
+  end
+  for i = 3, last do
+    local typ = redis.call("type", KEYS[i]).ok
+    local n = 0
+    if typ == "list" then
+      n = redis.call("lrem", KEYS[i], 0, ARGV[1])
+    elseif typ == "zset" then
+      n = redis.call("zrem", KEYS[i], ARGV[1])
+    end
+    if n > 0 then
+      redis.call("srem", KEYS[2], ARGV[1])
+      if ARGV[2] == "1" then
+        redis.call("del", KEYS[1])
+        if ARGV[3] == "1" then
+          redis.call("del", KEYS[table.getn(KEYS)])
+        end
+      else
+        redis.call("hset", KEYS[1], "state", "cancelled")
+      end
+      return 1
+    end
+  end
+  return 0`)
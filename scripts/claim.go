@@ -0,0 +1,30 @@
+package scripts
+
+import "github.com/garyburd/redigo/redis"
+
+// Claim tasks just moved onto the doing simpleq
+// Tasks whose meta hash (ARGV[3] .. id) has a deadline at or before now are expired instead:
+// they are moved onto the expired simpleq (failed or dead) with the reason, state and failure time set,
+// and removed from the unique set
+// The rest are marked as claimed by the worker with the claim token, and get a claim expiring at ARGV[2], unless it is 0
+// Returns the expired ids
+var Claim = redis.NewScript(
+	4, // KEYS:[claims_zset, doing_simpleq, expired_simpleq, unique_set], ARGV:[now, claim_deadline, meta_prefix, reason, expired_state, worker, token, id...]
+	`local expired = {}
+  for i = 8, table.getn(ARGV) do
+    local id = ARGV[i]
+    local deadline = redis.call("hget", ARGV[3] .. id, "deadline")
+    if deadline and tonumber(deadline) <= tonumber(ARGV[1]) then
+      redis.call("lrem", KEYS[2], 1, id)
+      redis.call("lpush", KEYS[3], id)
+      redis.call("hmset", ARGV[3] .. id, "reason", ARGV[4], "state", ARGV[5], "failed_at", ARGV[1])
+      redis.call("srem", KEYS[4], id)
+      table.insert(expired, id)
+    else
+      redis.call("hmset", ARGV[3] .. id, "state", "doing", "claimed_at", ARGV[1], "worker", ARGV[6], "claim", ARGV[7])
+      if ARGV[2] ~= "0" then
+        redis.call("zadd", KEYS[1], ARGV[2], id)
+      end
+    end
+  end
+  return expired`)
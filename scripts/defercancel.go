@@ -0,0 +1,43 @@
+package scripts
+
+import "github.com/garyburd/redigo/redis"
+
+// Remove a task from a deferred zset, and from the unique set if ARGV[2] is "1"
+// Its state is set to cancelled on its meta hash, if it has one
+// Returns 0 if the task was not deferred
+var DeferCancel = redis.NewScript(
+	3, // KEYS:[deferred_zset, unique_set, meta_hash], ARGV:[id, release]
+	`if redis.call("zrem", KEYS[1], ARGV[1]) == 0 then
+    return 0
+  end
+  if ARGV[2] == "1" then
+    redis.call("srem", KEYS[2], ARGV[1])
+  end
+  if redis.call("exists", KEYS[3]) == 1 then
+    redis.call("hset", KEYS[3], "state", "cancelled")
+  end
+  return 1`)
+
+// Remove a task from a deferred zset and from the unique set
+// Its meta hash is deleted if ARGV[2] is "1", otherwise its state is cleared
+// If given, KEYS[4] is the task's storage key and is set to ARGV[3], or deleted if that is not given
+// Returns 0 if the task was not deferred
+var DeferRemove = redis.NewScript(
+	-1, // KEYS:[deferred_zset, meta_hash, unique_set, (storage)], ARGV:[id, delete, (value)]
+	`if redis.call("zrem", KEYS[1], ARGV[1]) == 0 then
+    return 0
+  end
+  redis.call("srem", KEYS[3], ARGV[1])
+  if ARGV[2] == "1" then
+    redis.call("del", KEYS[2])
+  else
+    redis.call("hdel", KEYS[2], "state")
+  end
+  if KEYS[4] then
+    if ARGV[3] then
+      redis.call("set", KEYS[4], ARGV[3])
+    else
+      redis.call("del", KEYS[4])
+    end
+  end
+  return 1`)
@@ -2,12 +2,16 @@ package scripts
 
 import "github.com/garyburd/redigo/redis"
 
-// Move tasks from a deferred zset to the todo simpleq
+// Move tasks from a deferred zset back onto the todo simpleq of their priority level,
+// setting their state on their meta hashes (ARGV[2] .. id)
 var DeferMove = redis.NewScript(
-	2, // KEYS:[deferred_zset, todo_simpleq], ARGV:[now]
-	`local refs = redis.call("zrangebyscore", KEYS[1], 0, ARGV[1])
+	2, // KEYS:[deferred_zset, todo_simpleq], ARGV:[now, meta_prefix, delimiter, levels]
+	todoKey+`local refs = redis.call("zrangebyscore", KEYS[1], 0, ARGV[1])
   if table.getn(refs) > 0 then
-    redis.call("lpush", KEYS[2], unpack(refs))
     redis.call("zremrangebyscore", KEYS[1], 0, ARGV[1])
+    for i,id in pairs(refs) do
+      redis.call("lpush", todokey(ARGV[2] .. id, KEYS[2], ARGV[3], ARGV[4]), id)
+      redis.call("hset", ARGV[2] .. id, "state", "todo")
+    end
   end
   return refs`)
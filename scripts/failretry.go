@@ -0,0 +1,49 @@
+package scripts
+
+import "github.com/garyburd/redigo/redis"
+
+// Fail a task out of the doing simpleq, removing its claim and counting the attempt in its meta hash
+// The failure time is set on its meta hash, along with the error and its type if given
+// (otherwise the last error is cleared)
+// If it has attempts left, defer it into the retry zset with exponential backoff
+// The backoff is base * 2^(attempts-1), capped at max, with jitter in [0,1)
+// spread over its second half. Otherwise it is pushed onto the failed (or dead) simpleq
+// with its state set and, if given, the reason. It is also removed from the unique set.
+// If a claim token is given (ARGV[11]), the task must be in doing with that token on its meta hash
+// If given, KEYS[7] is the task's storage key and is set to ARGV[12]
+// Returns [attempts, retry_at] (retry_at is 0 if failed), nil if the task was not in doing,
+// or -1 if its claim was lost
+var FailRetry = redis.NewScript(
+	-1, // KEYS:[doing_simpleq, failed_simpleq, retry_zset, meta_hash, claims_zset, unique_set, (storage)], ARGV:[id, max_attempts, now, base_backoff, max_backoff, jitter, reason, state, error, error_type, token, (value)]
+	`if ARGV[11] ~= "" and (redis.call("hget", KEYS[4], "state") ~= "doing" or
+      redis.call("hget", KEYS[4], "claim") ~= ARGV[11]) then
+    return -1
+  end
+  if redis.call("lrem", KEYS[1], 1, ARGV[1]) == 0 then
+    return nil
+  end
+  redis.call("zrem", KEYS[5], ARGV[1])
+  if KEYS[7] then
+    redis.call("set", KEYS[7], ARGV[12])
+  end
+  redis.call("hset", KEYS[4], "failed_at", ARGV[3])
+  if ARGV[10] ~= "" then
+    redis.call("hmset", KEYS[4], "last_error", ARGV[9], "error_type", ARGV[10])
+  else
+    redis.call("hdel", KEYS[4], "last_error", "error_type")
+  end
+  local attempts = redis.call("hincrby", KEYS[4], "attempts", 1)
+  if attempts < tonumber(ARGV[2]) then
+    local backoff = math.min(tonumber(ARGV[4]) * 2 ^ (attempts - 1), tonumber(ARGV[5]))
+    local at = tonumber(ARGV[3]) + math.floor(backoff / 2 + backoff / 2 * tonumber(ARGV[6]))
+    redis.call("zadd", KEYS[3], at, ARGV[1])
+    redis.call("hset", KEYS[4], "state", "retrying")
+    return {attempts, at}
+  end
+  redis.call("lpush", KEYS[2], ARGV[1])
+  redis.call("srem", KEYS[6], ARGV[1])
+  redis.call("hset", KEYS[4], "state", ARGV[8])
+  if ARGV[7] ~= "" then
+    redis.call("hset", KEYS[4], "reason", ARGV[7])
+  end
+  return {attempts, 0}`)
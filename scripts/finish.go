@@ -0,0 +1,44 @@
+package scripts
+
+import "github.com/garyburd/redigo/redis"
+
+// Finish a task in the doing (or failed) simpleq, removing its claim and unique entry
+// It is pushed onto the done simpleq if ARGV[2] is "1"
+// Its meta hash is deleted if ARGV[3] is "1", otherwise its state is set to done and finished_at to ARGV[4]
+// If a claim token is given (ARGV[5]), the task must be in doing with that token on its meta hash,
+// or in failed (if it timed out); otherwise it was reclaimed or claimed again since
+// If given, KEYS[7] is the task's storage key and is set to ARGV[6], or deleted if that is not given
+// Returns 0 if the task was in neither doing nor failed, or -1 if its claim was lost
+var Finish = redis.NewScript(
+	-1, // KEYS:[doing_simpleq, failed_simpleq, done_simpleq, claims_zset, meta_hash, unique_set, (storage)], ARGV:[id, use_done, delete, now, token, (value)]
+	`if ARGV[5] ~= "" then
+    local state = redis.call("hget", KEYS[5], "state")
+    if state ~= "failed" and (state ~= "doing" or redis.call("hget", KEYS[5], "claim") ~= ARGV[5]) then
+      return -1
+    end
+  end
+  local n = redis.call("lrem", KEYS[1], 0, ARGV[1])
+  if n == 0 then
+    n = redis.call("lrem", KEYS[2], 0, ARGV[1])
+  end
+  if n == 0 then
+    return 0
+  end
+  redis.call("zrem", KEYS[4], ARGV[1])
+  redis.call("srem", KEYS[6], ARGV[1])
+  if ARGV[2] == "1" then
+    redis.call("lpush", KEYS[3], ARGV[1])
+  end
+  if ARGV[3] == "1" then
+    redis.call("del", KEYS[5])
+  else
+    redis.call("hmset", KEYS[5], "state", "done", "finished_at", ARGV[4])
+  end
+  if KEYS[7] then
+    if ARGV[6] then
+      redis.call("set", KEYS[7], ARGV[6])
+    else
+      redis.call("del", KEYS[7])
+    end
+  end
+  return 1`)
@@ -0,0 +1,42 @@
+package scripts
+
+import "github.com/garyburd/redigo/redis"
+
+// Move a task from the doing (or failed) simpleq to the dead simpleq, removing its claim
+// Its reason and state are set on its meta hash and it is removed from the unique set
+// If given, KEYS[7] is the task's storage key and is set to ARGV[3]
+// Returns 0 if the task was in neither doing nor failed
+var Kill = redis.NewScript(
+	-1, // KEYS:[doing_simpleq, failed_simpleq, dead_simpleq, claims_zset, meta_hash, unique_set, (storage)], ARGV:[id, reason, (value)]
+	`local n = redis.call("lrem", KEYS[1], 0, ARGV[1])
+  if n == 0 then
+    n = redis.call("lrem", KEYS[2], 0, ARGV[1])
+  end
+  if n == 0 then
+    return 0
+  end
+  redis.call("lpush", KEYS[3], ARGV[1])
+  redis.call("zrem", KEYS[4], ARGV[1])
+  redis.call("hmset", KEYS[5], "reason", ARGV[2], "state", "dead")
+  redis.call("srem", KEYS[6], ARGV[1])
+  if KEYS[7] then
+    redis.call("set", KEYS[7], ARGV[3])
+  end
+  return 1`)
+
+// Move a task from the dead simpleq back to the todo simpleq of its priority level
+// Its attempts and reason are cleared from its meta hash and its state is set to todo
+// If ARGV[2] is "1", it is added to the unique set
+// Returns 0 if the task was not dead
+var Resurrect = redis.NewScript(
+	4, // KEYS:[dead_simpleq, todo_simpleq, meta_hash, unique_set], ARGV:[id, unique, delimiter, levels]
+	todoKey+`if redis.call("lrem", KEYS[1], 0, ARGV[1]) == 0 then
+    return 0
+  end
+  redis.call("lpush", todokey(KEYS[3], KEYS[2], ARGV[3], ARGV[4]), ARGV[1])
+  redis.call("hdel", KEYS[3], "attempts", "reason")
+  redis.call("hset", KEYS[3], "state", "todo")
+  if ARGV[2] == "1" then
+    redis.call("sadd", KEYS[4], ARGV[1])
+  end
+  return 1`)
@@ -0,0 +1,20 @@
+package scripts
+
+import "github.com/garyburd/redigo/redis"
+
+// Pop up to n tasks from the todo simpleqs and push them onto doing
+// The todo simpleqs are drained in the order given
+var PopPipeN = redis.NewScript(
+	-1, // KEYS:[todo_simpleq..., doing_simpleq], ARGV:[n]
+	`local n = tonumber(ARGV[1])
+  local ids = {}
+  for i = 1, table.getn(KEYS) - 1 do
+    while table.getn(ids) < n do
+      local id = redis.call("rpoplpush", KEYS[i], KEYS[table.getn(KEYS)])
+      if not id then
+        break
+      end
+      table.insert(ids, id)
+    end
+  end
+  return ids`)
@@ -0,0 +1,15 @@
+package scripts
+
+import "github.com/garyburd/redigo/redis"
+
+// Pop the next task from the first non-empty todo simpleq and push it onto doing
+// The todo simpleqs are tried in the order given
+var PriorityPopPipe = redis.NewScript(
+	-1, // KEYS:[todo_simpleq..., doing_simpleq], ARGV:[]
+	`for i = 1, table.getn(KEYS) - 1 do
+    local id = redis.call("rpoplpush", KEYS[i], KEYS[table.getn(KEYS)])
+    if id then
+      return id
+    end
+  end
+  return nil`)
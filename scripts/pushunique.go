@@ -0,0 +1,29 @@
+package scripts
+
+import "github.com/garyburd/redigo/redis"
+
+// Push a task onto a simpleq (or, given a score, a zset) unless it is in the unique set already
+// Its state and enqueued time, and the deadline and priority level if given, are set on its meta hash
+// If given, KEYS[4] is the task's storage key and is set to ARGV[7]
+// Returns 0 if the task was a duplicate
+var PushUnique = redis.NewScript(
+	-1, // KEYS:[unique_set, target, meta_hash, (storage)], ARGV:[id, score, state, enqueued_at, deadline, priority, (value)]
+	`if redis.call("sadd", KEYS[1], ARGV[1]) == 0 then
+    return 0
+  end
+  if ARGV[2] == "" then
+    redis.call("lpush", KEYS[2], ARGV[1])
+  else
+    redis.call("zadd", KEYS[2], ARGV[2], ARGV[1])
+  end
+  redis.call("hmset", KEYS[3], "state", ARGV[3], "enqueued_at", ARGV[4])
+  if ARGV[5] ~= "" then
+    redis.call("hset", KEYS[3], "deadline", ARGV[5])
+  end
+  if ARGV[6] ~= "" then
+    redis.call("hset", KEYS[3], "priority", ARGV[6])
+  end
+  if KEYS[4] then
+    redis.call("set", KEYS[4], ARGV[7])
+  end
+  return 1`)
@@ -0,0 +1,38 @@
+package scripts
+
+import "github.com/garyburd/redigo/redis"
+
+// Reclaim tasks from the doing simpleq whose claims have expired
+// Tasks in doing without a claim are first given one expiring at ARGV[2]
+// Reclaimed tasks are pushed onto the target simpleq, their state is set and their claim token cleared
+// Without a reason, the target is the todo simpleq, and tasks go onto the one of their priority level
+// If a reason is given, it and the failure time are set on the task's meta hash (ARGV[3] .. id)
+// and the task is removed from the unique set
+var Reclaim = redis.NewScript(
+	4, // KEYS:[claims_zset, doing_simpleq, target_simpleq, unique_set], ARGV:[now, unclaimed_deadline, meta_prefix, reason, state, delimiter, levels]
+	todoKey+`local doing = redis.call("lrange", KEYS[2], 0, -1)
+  for i,id in pairs(doing) do
+    if not redis.call("zscore", KEYS[1], id) then
+      redis.call("zadd", KEYS[1], ARGV[2], id)
+    end
+  end
+  local refs = redis.call("zrangebyscore", KEYS[1], 0, ARGV[1])
+  local moved = {}
+  for i,id in pairs(refs) do
+    redis.call("zrem", KEYS[1], id)
+    if redis.call("lrem", KEYS[2], 1, id) > 0 then
+      local target = KEYS[3]
+      if ARGV[4] == "" then
+        target = todokey(ARGV[3] .. id, KEYS[3], ARGV[6], ARGV[7])
+      end
+      redis.call("lpush", target, id)
+      redis.call("hset", ARGV[3] .. id, "state", ARGV[5])
+      redis.call("hdel", ARGV[3] .. id, "claim")
+      if ARGV[4] ~= "" then
+        redis.call("hmset", ARGV[3] .. id, "reason", ARGV[4], "failed_at", ARGV[1])
+        redis.call("srem", KEYS[4], id)
+      end
+      table.insert(moved, id)
+    end
+  end
+  return moved`)
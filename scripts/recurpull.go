@@ -4,12 +4,16 @@ import "github.com/garyburd/redigo/redis"
 
 // Pull recurring tasks out of their zset
 // Get their intervals and update the next processing time
+// Returns the due tasks' ids, each followed by the time (in milliseconds) it was due
 var RecurPull = redis.NewScript(
 	1, // KEYS:[zset], ARGV:[now]
-	`local refs = redis.call("zrangebyscore", KEYS[1], 0, ARGV[1])
-  for i,ref in pairs(refs) do
+	`local refs = redis.call("zrangebyscore", KEYS[1], 0, ARGV[1], "withscores")
+  local due = {}
+  for i = 1, table.getn(refs), 2 do
+    local ref = refs[i]
     local tref, interval = string.match(ref, "([^|]*)|([0-9]+)")
     redis.call("zincrby", KEYS[1], interval, ref)
-    refs[i] = tref
+    table.insert(due, tref)
+    table.insert(due, string.format("%d", tonumber(refs[i + 1])))
   end
-  return refs`)
+  return due`)
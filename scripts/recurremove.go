@@ -0,0 +1,17 @@
+package scripts
+
+import "github.com/garyburd/redigo/redis"
+
+// Remove a recurring task from its zset by its id
+// Returns the number of refs removed
+var RecurRemove = redis.NewScript(
+	1, // KEYS:[zset], ARGV:[id]
+	`local refs = redis.call("zrange", KEYS[1], 0, -1)
+  local prefix = ARGV[1] .. "|"
+  local n = 0
+  for i,ref in pairs(refs) do
+    if string.sub(ref, 1, string.len(prefix)) == prefix then
+      n = n + redis.call("zrem", KEYS[1], ref)
+    end
+  end
+  return n`)
@@ -0,0 +1,31 @@
+package scripts
+
+import "github.com/garyburd/redigo/redis"
+
+// Remove a task from a simpleq, along with its claim
+// Its meta hash is deleted if ARGV[2] is "1", otherwise its state is cleared
+// It is removed from the unique set if ARGV[3] is "1"
+// If given, KEYS[5] is the task's storage key and is set to ARGV[4], or deleted if that is not given
+// Returns 0 if the task was not in the simpleq
+var Remove = redis.NewScript(
+	-1, // KEYS:[simpleq, claims_zset, meta_hash, unique_set, (storage)], ARGV:[id, delete, release, (value)]
+	`if redis.call("lrem", KEYS[1], 0, ARGV[1]) == 0 then
+    return 0
+  end
+  redis.call("zrem", KEYS[2], ARGV[1])
+  if ARGV[2] == "1" then
+    redis.call("del", KEYS[3])
+  else
+    redis.call("hdel", KEYS[3], "state")
+  end
+  if ARGV[3] == "1" then
+    redis.call("srem", KEYS[4], ARGV[1])
+  end
+  if KEYS[5] then
+    if ARGV[4] then
+      redis.call("set", KEYS[5], ARGV[4])
+    else
+      redis.call("del", KEYS[5])
+    end
+  end
+  return 1`)
@@ -0,0 +1,52 @@
+package scripts
+
+import "github.com/garyburd/redigo/redis"
+
+// Move a task from the failed (or doing) simpleq back to the todo simpleq of its priority level, removing its claim
+// Its state is set to todo
+// If ARGV[2] is "1", its attempts and reason are cleared from its meta hash
+// If ARGV[3] is "1", it is added to the unique set
+// Returns 0 if the task was in neither failed nor doing
+var Requeue = redis.NewScript(
+	6, // KEYS:[failed_simpleq, doing_simpleq, todo_simpleq, claims_zset, meta_hash, unique_set], ARGV:[id, reset, unique, delimiter, levels]
+	todoKey+`local n = redis.call("lrem", KEYS[1], 0, ARGV[1])
+  if n == 0 then
+    n = redis.call("lrem", KEYS[2], 0, ARGV[1])
+  end
+  if n == 0 then
+    return 0
+  end
+  redis.call("zrem", KEYS[4], ARGV[1])
+  redis.call("lpush", todokey(KEYS[5], KEYS[3], ARGV[4], ARGV[5]), ARGV[1])
+  redis.call("hset", KEYS[5], "state", "todo")
+  if ARGV[2] == "1" then
+    redis.call("hdel", KEYS[5], "attempts", "reason")
+  end
+  if ARGV[3] == "1" then
+    redis.call("sadd", KEYS[6], ARGV[1])
+  end
+  return 1`)
+
+// Move every task in a simpleq to the todo simpleq of its priority level, oldest first, removing their claims
+// Their state is set to todo
+// If ARGV[2] is "1", their attempts and reasons are cleared from their meta hashes (ARGV[1] .. id)
+// If ARGV[3] is "1", they are added to the unique set
+// Returns the number of tasks moved
+var RequeueAll = redis.NewScript(
+	4, // KEYS:[simpleq, todo_simpleq, claims_zset, unique_set], ARGV:[meta_prefix, reset, unique, delimiter, levels]
+	todoKey+`local n = 0
+  local id = redis.call("rpop", KEYS[1])
+  while id do
+    n = n + 1
+    redis.call("lpush", todokey(ARGV[1] .. id, KEYS[2], ARGV[4], ARGV[5]), id)
+    redis.call("zrem", KEYS[3], id)
+    redis.call("hset", ARGV[1] .. id, "state", "todo")
+    if ARGV[2] == "1" then
+      redis.call("hdel", ARGV[1] .. id, "attempts", "reason")
+    end
+    if ARGV[3] == "1" then
+      redis.call("sadd", KEYS[4], id)
+    end
+    id = redis.call("rpop", KEYS[1])
+  end
+  return n`)
@@ -0,0 +1,28 @@
+package scripts
+
+import "github.com/garyburd/redigo/redis"
+
+// Get the length of each simpleq or zset, and when the task at its front was enqueued
+// (from its meta hash, ARGV[1] .. id). The front of a simpleq is its next task to pop,
+// and of a zset its next task due.
+// Returns [length, enqueued_at] for each key, with enqueued_at 0 if unknown
+var Stats = redis.NewScript(
+	-1, // KEYS:[(simpleq|zset)...], ARGV:[meta_prefix]
+	`local stats = {}
+  for i,key in ipairs(KEYS) do
+    local typ = redis.call("type", key).ok
+    local n, front = 0, nil
+    if typ == "list" then
+      n = redis.call("llen", key)
+      front = redis.call("lindex", key, -1)
+    elseif typ == "zset" then
+      n = redis.call("zcard", key)
+      front = redis.call("zrange", key, 0, 0)[1]
+    end
+    local at = 0
+    if front then
+      at = tonumber(redis.call("hget", ARGV[1] .. front, "enqueued_at") or 0)
+    end
+    table.insert(stats, {n, at})
+  end
+  return stats`)
@@ -0,0 +1,13 @@
+package scripts
+
+// Lua function giving the todo simpleq a task goes back onto, by the priority level
+// on its meta hash: the base todo key for level 0, otherwise base .. delimiter .. level,
+// capped at the highest of the queue's levels
+const todoKey = `local function todokey(meta, base, delim, levels)
+    local level = math.min(tonumber(redis.call("hget", meta, "priority")) or 0, tonumber(levels) - 1)
+    if level <= 0 then
+      return base
+    end
+    return base .. delim .. level
+  end
+  `
@@ -0,0 +1,17 @@
+package scripts
+
+import "github.com/garyburd/redigo/redis"
+
+// Extend the claim on a task, if it still has one
+// If a claim token is given (ARGV[3]), it must match the one on the task's meta hash
+// Returns 0 if the claim was lost
+var Touch = redis.NewScript(
+	2, // KEYS:[claims_zset, meta_hash], ARGV:[id, claim_deadline, token]
+	`if ARGV[3] ~= "" and redis.call("hget", KEYS[2], "claim") ~= ARGV[3] then
+    return 0
+  end
+  if not redis.call("zscore", KEYS[1], ARGV[1]) then
+    return 0
+  end
+  redis.call("zadd", KEYS[1], ARGV[2], ARGV[1])
+  return 1`)
@@ -0,0 +1,36 @@
+package scripts
+
+import "github.com/garyburd/redigo/redis"
+
+// Trim up to ARGV[5] of the oldest tasks off a simpleq, deleting their meta hashes (ARGV[1] .. id)
+// Tasks are trimmed while there are more than ARGV[2] (unless it is 0), and then while
+// the oldest one's meta time field (ARGV[4]) is at or before ARGV[3] (unless it is 0).
+// Tasks without that time are trimmed by age too.
+// Returns the trimmed ids. If there are ARGV[5] of them, there may be more to trim.
+var Trim = redis.NewScript(
+	1, // KEYS:[simpleq], ARGV:[meta_prefix, max_length, cutoff, time_field, batch]
+	`local trimmed = {}
+  local batch = tonumber(ARGV[5])
+  local max = tonumber(ARGV[2])
+  if max > 0 then
+    local n = math.min(redis.call("llen", KEYS[1]) - max, batch)
+    for i = 1, n do
+      table.insert(trimmed, redis.call("rpop", KEYS[1]))
+    end
+  end
+  local cutoff = tonumber(ARGV[3])
+  if cutoff > 0 then
+    local id = redis.call("lindex", KEYS[1], -1)
+    while id and table.getn(trimmed) < batch do
+      local at = redis.call("hget", ARGV[1] .. id, ARGV[4])
+      if at and tonumber(at) > cutoff then
+        break
+      end
+      table.insert(trimmed, redis.call("rpop", KEYS[1]))
+      id = redis.call("lindex", KEYS[1], -1)
+    end
+  end
+  for i,id in ipairs(trimmed) do
+    redis.call("del", ARGV[1] .. id)
+  end
+  return trimmed`)
@@ -2,8 +2,10 @@
 package redisstorage
 
 import (
+	"context"
 	"github.com/Rafflecopter/golang-relyq/marshallers"
 	"github.com/garyburd/redigo/redis"
+	"time"
 )
 
 type RedisStorage struct {
@@ -45,6 +47,54 @@ func (rs *RedisStorage) Del(id []byte) error {
 	return err
 }
 
+// Get a task object. ctx's deadline bounds the redis call.
+func (rs *RedisStorage) GetContext(ctx context.Context, id []byte, obj interface{}) error {
+	val, err := redis.Bytes(rs.doContext(ctx, "GET", rs.prefixed(id)))
+
+	if err != nil {
+		return err
+	}
+
+	return rs.m.Unmarshal(val, obj)
+}
+
+// Save a task object. ctx's deadline bounds the redis call.
+func (rs *RedisStorage) SetContext(ctx context.Context, obj interface{}, id []byte) error {
+	val, err := rs.m.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	_, err = rs.doContext(ctx, "SET", rs.prefixed(id), val)
+	return err
+}
+
+// Delete a task object. ctx's deadline bounds the redis call.
+func (rs *RedisStorage) DelContext(ctx context.Context, id []byte) error {
+	_, err := rs.doContext(ctx, "DEL", rs.prefixed(id))
+	return err
+}
+
+// The pool the storage uses
+func (rs *RedisStorage) Pool() *redis.Pool {
+	return rs.pool
+}
+
+// The redis key a task is stored at
+func (rs *RedisStorage) Key(id []byte) string {
+	return string(rs.prefixed(id))
+}
+
+// Marshal a task the way Set would store it
+func (rs *RedisStorage) Marshal(obj interface{}) ([]byte, error) {
+	return rs.m.Marshal(obj)
+}
+
+// Unmarshal a task the way Get would read it
+func (rs *RedisStorage) Unmarshal(val []byte, obj interface{}) error {
+	return rs.m.Unmarshal(val, obj)
+}
+
 func (rs *RedisStorage) Close() error {
 	return nil
 }
@@ -55,6 +105,47 @@ func (rs *RedisStorage) do(cmd string, args ...interface{}) (interface{}, error)
 	return conn.Do(cmd, args...)
 }
 
+// Run a command on a connection got with ctx
+func (rs *RedisStorage) doContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	conn, err := rs.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return DoContext(ctx, conn, cmd, args...)
+}
+
+// Run a command, using ctx's deadline as the read timeout.
+// A context cancelled without a deadline is only noticed before the command is sent.
+func DoContext(ctx context.Context, conn redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dl, ok := ctx.Deadline()
+	if !ok {
+		return conn.Do(cmd, args...)
+	}
+
+	timeout := time.Until(dl)
+	if timeout <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+
+	reply, err := redis.DoWithTimeout(conn, timeout, cmd, args...)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if err != nil && !time.Now().Before(dl) {
+		// The read timed out just before ctx noticed its deadline
+		return nil, context.DeadlineExceeded
+	}
+	return reply, err
+}
+
 func (rs *RedisStorage) prefixed(id []byte) []byte {
 	return append([]byte(rs.prefix), id...)
 }